@@ -0,0 +1,128 @@
+// Binary squashfs-diff compares two SquashFS images (e.g. the root file system
+// which is running and an update) and prints the added, removed and modified
+// paths.
+//
+// Example:
+//
+//	squashfs-diff old.squashfs new.squashfs
+//	squashfs-diff -json old.squashfs new.squashfs > changes.json
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/gokrazy/internal/humanize"
+	"github.com/gokrazy/internal/squashfs"
+)
+
+// report is the JSON output format.
+type report struct {
+	Changes   []squashfs.Change `json:"changes"`
+	SizeDelta int64             `json:"size_delta"` // of all regular files
+}
+
+func openImage(path string) (*squashfs.Reader, *os.File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err := squashfs.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return r, f, nil
+}
+
+// formatDelta formats a size delta in bytes with an explicit sign.
+func formatDelta(delta int64) string {
+	if delta < 0 {
+		return "-" + humanize.Bytes(uint64(-delta))
+	}
+	return "+" + humanize.Bytes(uint64(delta))
+}
+
+func describe(c squashfs.Change) string {
+	var details []string
+	for _, field := range c.Fields {
+		switch field {
+		case "type", "mode":
+			details = append(details, fmt.Sprintf("%s %v → %v", field, c.Old.Mode, c.New.Mode))
+		case "owner":
+			details = append(details, fmt.Sprintf("owner %d:%d → %d:%d", c.Old.Uid, c.Old.Gid, c.New.Uid, c.New.Gid))
+		case "mtime":
+			details = append(details, fmt.Sprintf("mtime %v → %v", c.Old.ModTime, c.New.ModTime))
+		case "target":
+			details = append(details, fmt.Sprintf("target %q → %q", c.Old.Target, c.New.Target))
+		case "size":
+			details = append(details, fmt.Sprintf("size %s", formatDelta(c.SizeDelta)))
+		default:
+			details = append(details, field)
+		}
+	}
+	switch c.Kind {
+	case squashfs.Added:
+		return fmt.Sprintf("A %s (%v, %s)", c.Path, c.New.Mode, formatDelta(c.SizeDelta))
+	case squashfs.Removed:
+		return fmt.Sprintf("D %s (%v, %s)", c.Path, c.Old.Mode, formatDelta(c.SizeDelta))
+	default:
+		return fmt.Sprintf("M %s: %s", c.Path, strings.Join(details, ", "))
+	}
+}
+
+func main() {
+	var (
+		jsonOutput = flag.Bool("json", false, "print the changes as JSON")
+		modTime    = flag.Bool("mtime", false, "report changed modification times")
+	)
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] <old.squashfs> <new.squashfs>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	oldImage, oldFile, err := openImage(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer oldFile.Close()
+	newImage, newFile, err := openImage(flag.Arg(1))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer newFile.Close()
+
+	changes, err := squashfs.Diff(oldImage, newImage, squashfs.DiffOptions{
+		ModTime: *modTime,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	rep := report{Changes: changes}
+	if rep.Changes == nil {
+		rep.Changes = []squashfs.Change{} // encode as [], not null
+	}
+	for _, c := range changes {
+		rep.SizeDelta += c.SizeDelta
+	}
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(rep); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	for _, c := range changes {
+		fmt.Println(describe(c))
+	}
+	fmt.Printf("%d changes, total size %s\n", len(changes), formatDelta(rep.SizeDelta))
+}
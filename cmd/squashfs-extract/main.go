@@ -0,0 +1,48 @@
+// Binary squashfs-extract extracts a SquashFS image (e.g. a gokrazy root file
+// system) to a directory, without requiring squashfs-tools.
+//
+// Example:
+//
+//	squashfs-extract root.squashfs /tmp/root
+//	squashfs-extract -path etc root.squashfs /tmp/etc
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/gokrazy/internal/squashfs"
+)
+
+func main() {
+	var (
+		subtree = flag.String("path", "", "path of the subtree to extract (default: the whole image)")
+		owner   = flag.Bool("owner", false, "set the owner of extracted files (usually requires root privileges)")
+	)
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] <image.squashfs> <destdir>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	f, err := os.Open(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	r, err := squashfs.NewReader(f)
+	if err != nil {
+		log.Fatalf("%s: %v", flag.Arg(0), err)
+	}
+	if err := squashfs.Extract(r, flag.Arg(1), squashfs.ExtractOptions{
+		Path:  *subtree,
+		Owner: *owner,
+	}); err != nil {
+		log.Fatal(err)
+	}
+}
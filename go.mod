@@ -4,5 +4,8 @@ go 1.24
 
 require (
 	github.com/google/go-cmp v0.5.9
+	github.com/klauspost/compress v1.18.0
+	github.com/pierrec/lz4/v4 v4.1.22
 	github.com/spf13/pflag v1.0.5
+	github.com/ulikunitz/xz v0.5.12
 )
@@ -0,0 +1,354 @@
+package squashfs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// CheckError lists the problems found by Check.
+type CheckError struct {
+	Problems []string
+}
+
+func (e *CheckError) Error() string {
+	return fmt.Sprintf("squashfs: image has %d problem(s): %s", len(e.Problems), strings.Join(e.Problems, "; "))
+}
+
+// checker holds the state of Check.
+type checker struct {
+	r        *Reader
+	problems []string
+
+	// dataEnd, inodeEnd and dirEnd are the (exclusive) end offsets of the
+	// data area, the inode table and the directory table.
+	dataEnd, inodeEnd, dirEnd int64
+
+	// refs counts directory entries per non-directory inode.
+	refs map[inode]*refCount
+
+	// numbers maps inode numbers to the inode using it.
+	numbers map[uint32]inode
+}
+
+type refCount struct {
+	path  string // first path referring to the inode
+	nlink uint32 // as stored in the inode
+	count uint32
+}
+
+func (c *checker) errorf(format string, args ...any) {
+	c.problems = append(c.problems, fmt.Sprintf(format, args...))
+}
+
+// Check verifies the structure of the SquashFS image read from r, such as an
+// image created by Writer: the superblock values, the location of all tables,
+// references to inodes, directories, data blocks and fragments, the order of
+// directory entries, link counts, and the padding after the image. File
+// contents are not decompressed.
+//
+// If any problems are found, a *CheckError is returned.
+func Check(r io.ReaderAt) error {
+	rd, err := NewReader(r)
+	if err != nil {
+		return &CheckError{Problems: []string{err.Error()}}
+	}
+	c := &checker{
+		r:       rd,
+		refs:    make(map[inode]*refCount),
+		numbers: make(map[uint32]inode),
+	}
+	c.check()
+	if len(c.problems) > 0 {
+		return &CheckError{Problems: c.problems}
+	}
+	return nil
+}
+
+// tableIndexEnd returns the end offset of the index (list of uint64 metadata
+// block offsets) of a table with entries of entrySize bytes, starting at
+// start. The offset of the first metadata block is returned, too, if any.
+func (c *checker) tableIndexEnd(name string, start int64, entries uint32, entrySize int64) (first, end int64) {
+	blocks := (int64(entries)*entrySize + metadataBlockSize - 1) / metadataBlockSize
+	end = start + 8*blocks
+	first = -1
+	if blocks > 0 {
+		var off int64
+		if err := binary.Read(io.NewSectionReader(c.r.r, start, 8), binary.LittleEndian, &off); err != nil {
+			c.errorf("%s: reading index: %v", name, err)
+			return -1, end
+		}
+		first = off
+	}
+	return first, end
+}
+
+func (c *checker) check() {
+	sb := c.r.sb
+	if sb.BlockSize < 4096 || sb.BlockSize > 1<<20 {
+		c.errorf("superblock: block size %d out of range [4096, 1 MiB]", sb.BlockSize)
+	}
+	if sb.NoIds == 0 {
+		c.errorf("superblock: no ids")
+	}
+
+	// Verify the order of the tables, and determine where each table ends.
+	var (
+		tables = []struct {
+			name  string
+			start int64
+		}{
+			{"inode table", sb.InodeTableStart},
+			{"directory table", sb.DirectoryTableStart},
+		}
+		// starts contains the start offsets of all structures following the
+		// directory table.
+		starts = []int64{sb.BytesUsed}
+		ends   []int64
+	)
+	first, end := c.tableIndexEnd("fragment table", sb.FragmentTableStart, sb.Fragments, 16)
+	starts = append(starts, sb.FragmentTableStart, first)
+	ends = append(ends, end)
+	first, end = c.tableIndexEnd("id table", sb.IdTableStart, uint32(sb.NoIds), 4)
+	starts = append(starts, sb.IdTableStart, first)
+	ends = append(ends, end)
+	if sb.XattrIdTableStart != -1 {
+		var hdr xattrIdTable
+		if err := binary.Read(io.NewSectionReader(c.r.r, sb.XattrIdTableStart, 16), binary.LittleEndian, &hdr); err != nil {
+			c.errorf("xattr id table: reading header: %v", err)
+		} else {
+			first, end = c.tableIndexEnd("xattr id table", sb.XattrIdTableStart+16, hdr.XattrIds, 16)
+			starts = append(starts, hdr.XattrTableStart, sb.XattrIdTableStart, first)
+			ends = append(ends, end)
+		}
+	}
+	if sb.LookupTableStart != -1 {
+		first, end = c.tableIndexEnd("export table", sb.LookupTableStart, sb.Inodes, 8)
+		starts = append(starts, sb.LookupTableStart, first)
+		ends = append(ends, end)
+	}
+	prev := int64(96)
+	for _, t := range tables {
+		if t.start < prev || t.start > sb.BytesUsed {
+			c.errorf("superblock: %s start %d out of range [%d, %d]", t.name, t.start, prev, sb.BytesUsed)
+		}
+		prev = t.start
+	}
+	c.dataEnd = sb.InodeTableStart
+	c.inodeEnd = sb.DirectoryTableStart
+	c.dirEnd = sb.BytesUsed
+	for _, start := range starts {
+		if start < 0 {
+			continue // not present
+		}
+		if start < sb.DirectoryTableStart || start > sb.BytesUsed {
+			c.errorf("superblock: table at %d out of range [%d, %d]", start, sb.DirectoryTableStart, sb.BytesUsed)
+			continue
+		}
+		c.dirEnd = min(c.dirEnd, start)
+	}
+
+	// bytes_used must point to the end of the last table, and the image must
+	// be padded with zeros to a multiple of 4096 bytes.
+	want := c.dirEnd
+	for _, end := range ends {
+		want = max(want, end)
+	}
+	if sb.BytesUsed != want {
+		c.errorf("superblock: bytes_used is %d, but the last table ends at %d", sb.BytesUsed, want)
+	}
+	if rest := sb.BytesUsed % 4096; rest > 0 {
+		padding := make([]byte, 4096-rest)
+		if _, err := c.r.r.ReadAt(padding, sb.BytesUsed); err != nil {
+			c.errorf("image not padded to a multiple of 4096 bytes: %v", err)
+		} else if strings.Trim(string(padding), "\x00") != "" {
+			c.errorf("padding after bytes_used contains non-zero bytes")
+		}
+	}
+
+	for idx, fe := range c.r.fragments {
+		size := int64(fe.Size &^ (1 << 24))
+		if size > int64(sb.BlockSize) {
+			c.errorf("fragment %d: invalid size %d", idx, size)
+		}
+		if fe.Start < 96 || fe.Start+size > c.dataEnd {
+			c.errorf("fragment %d: [%d, %d) outside of data area [96, %d)", idx, fe.Start, fe.Start+size, c.dataEnd)
+		}
+	}
+
+	if c.problems != nil {
+		return // do not walk the tree based on inconsistent table locations
+	}
+	root, ok := c.inode("/", sb.RootInode)
+	if !ok {
+		return
+	}
+	if root.typ != dirType {
+		c.errorf("/: root inode has type %d, want directory", root.typ)
+		return
+	}
+	c.checkDir("/", root, map[uint32]bool{})
+
+	// Verify the link count of all non-directory inodes.
+	refs := make([]inode, 0, len(c.refs))
+	for ref := range c.refs {
+		refs = append(refs, ref)
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i] < refs[j] })
+	for _, ref := range refs {
+		rc := c.refs[ref]
+		if rc.nlink != rc.count {
+			c.errorf("%s: link count is %d, but %d directory entries refer to the inode", rc.path, rc.nlink, rc.count)
+		}
+	}
+	if got := uint32(len(c.numbers)); got != sb.Inodes {
+		c.errorf("superblock: inode count is %d, but the image contains %d inodes", sb.Inodes, got)
+	}
+}
+
+// inode reads and checks the inode referenced by ref.
+func (c *checker) inode(p string, ref inode) (*inodeInfo, bool) {
+	if block := int64(ref >> 16); c.r.sb.InodeTableStart+block >= c.inodeEnd {
+		c.errorf("%s: inode reference %#x outside of the inode table", p, ref)
+		return nil, false
+	}
+	ino, err := c.r.readInode(ref)
+	if err != nil {
+		c.errorf("%s: %v", p, err)
+		return nil, false
+	}
+	if other, ok := c.numbers[ino.number]; ok && other != ref {
+		c.errorf("%s: inode number %d is used by multiple inodes", p, ino.number)
+	}
+	c.numbers[ino.number] = ref
+	if ino.number == 0 || ino.number > c.r.sb.Inodes {
+		c.errorf("%s: inode number %d out of range [1, %d]", p, ino.number, c.r.sb.Inodes)
+	}
+	if ino.xattr != invalidXattr {
+		if _, err := c.r.readXattrs(ino.xattr); err != nil {
+			c.errorf("%s: %v", p, err)
+		}
+	}
+	switch ino.typ {
+	case fileType:
+		c.checkFile(p, ino)
+	case symlinkType:
+		if ino.target == "" {
+			c.errorf("%s: empty symlink target", p)
+		}
+	}
+	return ino, true
+}
+
+// checkFile verifies that the data blocks and fragment of the regular file ino
+// are within the data area.
+func (c *checker) checkFile(p string, ino *inodeInfo) {
+	blockSize := int64(c.r.sb.BlockSize)
+	end := ino.startBlock
+	for idx, size := range ino.blockSizes {
+		size &^= 1 << 24
+		if int64(size) > blockSize {
+			c.errorf("%s: block %d: invalid size %d", p, idx, size)
+		}
+		end += int64(size)
+	}
+	if len(ino.blockSizes) > 0 && (ino.startBlock < 96 || end > c.dataEnd) {
+		c.errorf("%s: data blocks [%d, %d) outside of data area [96, %d)", p, ino.startBlock, end, c.dataEnd)
+	}
+	if ino.fragment == invalidFragment {
+		return
+	}
+	if int64(ino.fragment) >= int64(len(c.r.fragments)) {
+		c.errorf("%s: fragment index %d out of range [0, %d)", p, ino.fragment, len(c.r.fragments))
+		return
+	}
+	if tail := ino.size % blockSize; int64(ino.fragOffset)+tail > blockSize {
+		c.errorf("%s: fragment offset %d + tail size %d exceeds block size", p, ino.fragOffset, tail)
+	}
+}
+
+// checkDir checks all entries of the directory ino (at path p) recursively.
+// visiting contains the inode numbers of p and its parents.
+func (c *checker) checkDir(p string, ino *inodeInfo, visiting map[uint32]bool) {
+	if visiting[ino.number] {
+		c.errorf("%s: directory loop", p)
+		return
+	}
+	visiting[ino.number] = true
+	defer delete(visiting, ino.number)
+
+	if block := int64(ino.dirBlock); ino.size > 3 && c.r.sb.DirectoryTableStart+block >= c.dirEnd {
+		c.errorf("%s: directory reference outside of the directory table", p)
+		return
+	}
+	entries, err := c.r.readDir(ino)
+	if err != nil {
+		c.errorf("%s: %v", p, err)
+		return
+	}
+	c.checkDirIndex(p, ino)
+	var subdirs uint32
+	for idx, de := range entries {
+		entryPath := strings.TrimSuffix(p, "/") + "/" + de.name
+		if de.name == "" || de.name == "." || de.name == ".." || strings.Contains(de.name, "/") {
+			c.errorf("%s: invalid directory entry name %q", p, de.name)
+		}
+		if idx > 0 && entries[idx-1].name >= de.name {
+			c.errorf("%s: directory entries not sorted: %q before %q", p, entries[idx-1].name, de.name)
+		}
+		child, ok := c.inode(entryPath, de.ref)
+		if !ok {
+			continue
+		}
+		if basicType(de.typ) != child.typ {
+			c.errorf("%s: directory entry type %d does not match inode type %d", entryPath, de.typ, child.typ)
+		}
+		if de.number != child.number {
+			c.errorf("%s: directory entry inode number %d does not match inode number %d", entryPath, de.number, child.number)
+		}
+		if child.typ != dirType {
+			rc, ok := c.refs[de.ref]
+			if !ok {
+				rc = &refCount{path: entryPath, nlink: child.nlink}
+				c.refs[de.ref] = rc
+			}
+			rc.count++
+			continue
+		}
+		subdirs++
+		if child.parent != ino.number {
+			c.errorf("%s: parent inode number is %d, want %d", entryPath, child.parent, ino.number)
+		}
+		c.checkDir(entryPath, child, visiting)
+	}
+	if want := subdirs + 2; ino.nlink != want {
+		c.errorf("%s: link count is %d, want %d (2 + %d subdirectories)", p, ino.nlink, want, subdirs)
+	}
+}
+
+// checkDirIndex verifies that each directory index entry of the directory ino
+// (at path p) refers to a directory header whose first entry has the indexed
+// name, as the kernel relies on the index for lookups.
+func (c *checker) checkDirIndex(p string, ino *inodeInfo) {
+	for idx, ie := range ino.index {
+		if idx > 0 {
+			if prev := ino.index[idx-1]; ie.Index <= prev.Index || ie.name <= prev.name {
+				c.errorf("%s: directory index entries not sorted: %q (offset %d) before %q (offset %d)", p, prev.name, prev.Index, ie.name, ie.Index)
+			}
+		}
+		if int64(ie.Index) >= ino.size-3 || c.r.sb.DirectoryTableStart+int64(ie.StartBlock) >= c.dirEnd {
+			c.errorf("%s: directory index entry %q out of range", p, ie.name)
+			continue
+		}
+		var first string
+		err := c.r.walkDir(ino, int64(ie.Index), ie.StartBlock, func(de rawDirEntry) bool {
+			first = de.name
+			return false
+		})
+		if err != nil || first != ie.name {
+			c.errorf("%s: directory index entry %q does not refer to a directory header starting with it", p, ie.name)
+		}
+	}
+}
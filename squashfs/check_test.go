@@ -0,0 +1,226 @@
+package squashfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func checkTestImage(t *testing.T) []byte {
+	t.Helper()
+	f := writeTestImage(t, func(w *Writer) {
+		writeTestFile(t, w.Root, "aa", 0o644, []byte("first file"))
+		writeTestFile(t, w.Root, "bb", 0o644, bytes.Repeat([]byte("second file "), dataBlockSize/8))
+		subdir := addTestDirectory(t, w.Root, "subdir", time.Now(), 0o755)
+		if err := subdir.Symlink("../aa", "link", time.Now(), 0o777); err != nil {
+			t.Fatal(err)
+		}
+	})
+	b, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestCheck(t *testing.T) {
+	t.Parallel()
+
+	f := writeTestImage(t, func(w *Writer) {
+		writeTestFile(t, w.Root, "empty", 0o644, nil)
+		writeTestFile(t, w.Root, "large", 0o644, bytes.Repeat([]byte("gokrazy "), 3*dataBlockSize/8+17))
+		writeTestFile(t, w.Root, "sparse", 0o644, make([]byte, 2*dataBlockSize))
+		if err := w.Root.Link("large-link", "/large"); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.AddDevice("/dev/null", 1, 3, time.Now(), os.ModeDevice|os.ModeCharDevice|0o666); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.AddFifo("/dev/fifo", time.Now(), os.ModeNamedPipe|0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.AddSymlink("null", "/dev/zero", time.Now(), 0o777, WithOwner(1000, 1000)); err != nil {
+			t.Fatal(err)
+		}
+		f, err := w.AddFile("/usr/bin/ping", time.Now(), 0o755, WithCapabilities(CapNetBindService))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte("#!/bin/sh\n")); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+		// more than 256 entries, i.e. more than one directory header
+		many := addTestDirectory(t, w.Root, "many", time.Now(), 0o755)
+		for i := 0; i < 300; i++ {
+			writeTestFile(t, many, fmt.Sprintf("file%03d", i), 0o644, nil)
+		}
+	}, WithMetadataCompression())
+	if err := Check(f); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckCorrupt(t *testing.T) {
+	t.Parallel()
+
+	patchSuperblock := func(b []byte, patch func(sb *superblock)) {
+		var sb superblock
+		if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, &sb); err != nil {
+			t.Fatal(err)
+		}
+		patch(&sb)
+		var buf bytes.Buffer
+		if err := binary.Write(&buf, binary.LittleEndian, &sb); err != nil {
+			t.Fatal(err)
+		}
+		copy(b, buf.Bytes())
+	}
+	superblockOf := func(b []byte) superblock {
+		var sb superblock
+		patchSuperblock(b, func(s *superblock) { sb = *s })
+		return sb
+	}
+
+	for _, tt := range []struct {
+		name    string
+		corrupt func(b []byte) []byte
+		want    string
+	}{
+		{
+			name: "bad magic",
+			corrupt: func(b []byte) []byte {
+				patchSuperblock(b, func(sb *superblock) { sb.Magic = 0 })
+				return b
+			},
+			want: "invalid magic",
+		},
+
+		{
+			name: "bytes_used",
+			corrupt: func(b []byte) []byte {
+				patchSuperblock(b, func(sb *superblock) { sb.BytesUsed += 8 })
+				return b
+			},
+			want: "bytes_used",
+		},
+
+		{
+			name: "bytes_used beyond image",
+			corrupt: func(b []byte) []byte {
+				patchSuperblock(b, func(sb *superblock) { sb.BytesUsed = 1 << 40 })
+				return b
+			},
+			want: "exceeds image size",
+		},
+
+		{
+			name: "fragment count",
+			corrupt: func(b []byte) []byte {
+				patchSuperblock(b, func(sb *superblock) { sb.Fragments = math.MaxUint32 })
+				return b
+			},
+			want: "fragment count",
+		},
+
+		{
+			name: "id count",
+			corrupt: func(b []byte) []byte {
+				patchSuperblock(b, func(sb *superblock) { sb.NoIds = math.MaxUint16 })
+				return b
+			},
+			want: "reading id table",
+		},
+
+		{
+			name: "table order",
+			corrupt: func(b []byte) []byte {
+				patchSuperblock(b, func(sb *superblock) { sb.DirectoryTableStart = sb.InodeTableStart - 1 })
+				return b
+			},
+			want: "directory table start",
+		},
+
+		{
+			name: "missing padding",
+			corrupt: func(b []byte) []byte {
+				return b[:superblockOf(b).BytesUsed]
+			},
+			want: "not padded",
+		},
+
+		{
+			name: "non-zero padding",
+			corrupt: func(b []byte) []byte {
+				b[len(b)-1] = 1
+				return b
+			},
+			want: "padding",
+		},
+
+		{
+			name: "root inode out of range",
+			corrupt: func(b []byte) []byte {
+				patchSuperblock(b, func(sb *superblock) {
+					sb.RootInode = inode(sb.DirectoryTableStart-sb.InodeTableStart) << 16
+				})
+				return b
+			},
+			want: "outside of the inode table",
+		},
+
+		{
+			name: "inode count",
+			corrupt: func(b []byte) []byte {
+				patchSuperblock(b, func(sb *superblock) { sb.Inodes++ })
+				return b
+			},
+			want: "inode count",
+		},
+
+		{
+			name: "unsorted directory",
+			corrupt: func(b []byte) []byte {
+				sb := superblockOf(b)
+				dirTable := b[sb.DirectoryTableStart:sb.FragmentTableStart]
+				copy(dirTable, bytes.Replace(dirTable, []byte("bb"), []byte("00"), 1))
+				return b
+			},
+			want: "not sorted",
+		},
+
+		{
+			name: "directory link count",
+			corrupt: func(b []byte) []byte {
+				sb := superblockOf(b)
+				// Skip the metadata block header, the inode header and the
+				// start block of the root directory inode.
+				off := sb.InodeTableStart + int64(sb.RootInode>>16) + 2 + int64(sb.RootInode&0xFFFF) + 16 + 4
+				binary.LittleEndian.PutUint32(b[off:], 2)
+				return b
+			},
+			want: "link count is 2, want 3",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			b := tt.corrupt(checkTestImage(t))
+			err := Check(bytes.NewReader(b))
+			var cerr *CheckError
+			if !errors.As(err, &cerr) {
+				t.Fatalf("Check = %v, want a *CheckError", err)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Check = %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,335 @@
+package squashfs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
+)
+
+// A Compressor compresses data and metadata blocks of a SquashFS image, see
+// WithCompressor. Implementations must be safe for concurrent use.
+//
+// Note that the kernel which mounts the image must support the corresponding
+// decompressor (e.g. CONFIG_SQUASHFS_XZ for XZ).
+type Compressor interface {
+	// ID returns the compression id stored in the superblock, e.g. 1 for zlib.
+	ID() uint16
+
+	// Options returns the compressor-specific options which are stored
+	// following the superblock, or nil if there are none.
+	Options() []byte
+
+	// Compress appends the compressed contents of src to dst and returns the
+	// resulting slice. If the result is not smaller than src, the block is
+	// stored uncompressed instead.
+	Compress(dst, src []byte) ([]byte, error)
+}
+
+// validator is implemented by the Compressors of this package, whose
+// constructors do not return errors: NewWriter reports invalid parameters.
+type validator interface {
+	validate() error
+}
+
+// Zlib returns a Compressor which uses zlib at the specified compression
+// level, which must be between zlib.BestSpeed and zlib.BestCompression.
+// zlib.DefaultCompression selects zlib.BestCompression, like mksquashfs(1).
+func Zlib(level int) Compressor {
+	if level == zlib.DefaultCompression {
+		level = zlib.BestCompression
+	}
+	return &zlibCompressor{level: level}
+}
+
+type zlibCompressor struct {
+	level   int
+	writers sync.Pool
+}
+
+func (c *zlibCompressor) ID() uint16 { return zlibCompression }
+
+func (c *zlibCompressor) validate() error {
+	if c.level < zlib.BestSpeed || c.level > zlib.BestCompression {
+		return fmt.Errorf("squashfs: invalid zlib compression level %d (must be between %d and %d)", c.level, zlib.BestSpeed, zlib.BestCompression)
+	}
+	return nil
+}
+
+func (c *zlibCompressor) Options() []byte {
+	if c.level == zlib.BestCompression {
+		return nil // default
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, struct {
+		CompressionLevel uint32
+		WindowSize       uint16
+		Strategy         uint16
+	}{
+		CompressionLevel: uint32(c.level),
+		WindowSize:       15, // compress/zlib always uses a 32 KB window
+	})
+	return buf.Bytes()
+}
+
+func (c *zlibCompressor) Compress(dst, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	zw, ok := c.writers.Get().(*zlib.Writer)
+	if ok {
+		zw.Reset(buf)
+	} else {
+		var err error
+		zw, err = zlib.NewWriterLevel(buf, c.level)
+		if err != nil {
+			return nil, err
+		}
+	}
+	defer c.writers.Put(zw)
+	if _, err := zw.Write(src); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// XZ returns a Compressor which uses XZ (LZMA2) with a dictionary of one data
+// block. XZ typically results in the smallest images, but is slow to
+// decompress.
+func XZ() Compressor {
+	return xzCompressor{}
+}
+
+type xzCompressor struct{}
+
+func (xzCompressor) ID() uint16 { return xzCompression }
+
+func (xzCompressor) Options() []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, struct {
+		DictionarySize uint32
+		Filters        uint32
+	}{
+		DictionarySize: dataBlockSize,
+		Filters:        0, // no BCJ filters
+	})
+	return buf.Bytes()
+}
+
+func (xzCompressor) Compress(dst, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	xw, err := xz.WriterConfig{
+		DictCap: dataBlockSize,
+		// Linux only supports CRC32 (or no) checksums in XZ streams.
+		CheckSum: xz.CRC32,
+	}.NewWriter(buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := xw.Write(src); err != nil {
+		return nil, err
+	}
+	if err := xw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// LZ4 returns a Compressor which uses LZ4, optionally in high compression
+// mode. LZ4 is very fast to decompress, but results in larger images.
+func LZ4(highCompression bool) Compressor {
+	return &lz4Compressor{hc: highCompression}
+}
+
+type lz4Compressor struct {
+	hc bool
+
+	// compressors holds *lz4.Compressor or *lz4.CompressorHC values, which
+	// contain large hash tables.
+	compressors sync.Pool
+}
+
+const (
+	lz4Legacy = 1 // the only LZ4 format version defined by SquashFS
+	lz4HC     = 1 // flag for LZ4 high compression mode
+)
+
+func (c *lz4Compressor) ID() uint16 { return lz4Compression }
+
+func (c *lz4Compressor) Options() []byte {
+	// LZ4 options are mandatory: unsquashfs(1) refuses images without them.
+	opts := struct {
+		Version uint32
+		Flags   uint32
+	}{
+		Version: lz4Legacy,
+	}
+	if c.hc {
+		opts.Flags = lz4HC
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, opts)
+	return buf.Bytes()
+}
+
+func (c *lz4Compressor) Compress(dst, src []byte) ([]byte, error) {
+	n := len(dst)
+	bound := lz4.CompressBlockBound(len(src))
+	dst = append(dst, make([]byte, bound)...)
+	var (
+		size int
+		err  error
+	)
+	if c.hc {
+		lc, ok := c.compressors.Get().(*lz4.CompressorHC)
+		if !ok {
+			lc = &lz4.CompressorHC{}
+		}
+		size, err = lc.CompressBlock(src, dst[n:])
+		c.compressors.Put(lc)
+	} else {
+		lc, ok := c.compressors.Get().(*lz4.Compressor)
+		if !ok {
+			lc = &lz4.Compressor{}
+		}
+		size, err = lc.CompressBlock(src, dst[n:])
+		c.compressors.Put(lc)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return dst[:n+size], nil
+}
+
+// Zstd returns a Compressor which uses Zstandard at the specified compression
+// level (1 to 22).
+func Zstd(level int) Compressor {
+	return &zstdCompressor{level: level}
+}
+
+type zstdCompressor struct {
+	level int
+
+	once    sync.Once
+	encoder *zstd.Encoder
+	err     error
+}
+
+func (c *zstdCompressor) ID() uint16 { return zstdCompression }
+
+func (c *zstdCompressor) validate() error {
+	if c.level < 1 || c.level > 22 {
+		return fmt.Errorf("squashfs: invalid zstd compression level %d (must be between 1 and 22)", c.level)
+	}
+	return nil
+}
+
+func (c *zstdCompressor) Options() []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, uint32(c.level))
+	return buf.Bytes()
+}
+
+func (c *zstdCompressor) Compress(dst, src []byte) ([]byte, error) {
+	c.once.Do(func() {
+		c.encoder, c.err = zstd.NewWriter(nil,
+			zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(c.level)),
+			zstd.WithWindowSize(dataBlockSize),
+			zstd.WithEncoderCRC(false))
+	})
+	if c.err != nil {
+		return nil, c.err
+	}
+	return c.encoder.EncodeAll(src, dst), nil
+}
+
+// Uncompressed returns a Compressor which stores all blocks uncompressed.
+func Uncompressed() Compressor {
+	return uncompressed{}
+}
+
+type uncompressed struct{}
+
+// ID returns zlib: SquashFS has no compression id for uncompressed images,
+// but readers never need to decompress any block.
+func (uncompressed) ID() uint16 { return zlibCompression }
+
+func (uncompressed) Options() []byte { return nil }
+
+func (uncompressed) Compress(dst, src []byte) ([]byte, error) {
+	return append(dst, src...), nil
+}
+
+var (
+	zstdDecoderOnce sync.Once
+	zstdDecoder     *zstd.Decoder
+	zstdDecoderErr  error
+)
+
+// decompress returns the decompressed contents of src (compressed using the
+// algorithm identified by compression id), which must not exceed limit bytes.
+func decompress(id uint16, src []byte, limit int) ([]byte, error) {
+	var (
+		b   []byte
+		err error
+	)
+	switch id {
+	case zlibCompression:
+		var zr io.ReadCloser
+		zr, err = zlib.NewReader(bytes.NewReader(src))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		b, err = io.ReadAll(io.LimitReader(zr, int64(limit)+1))
+
+	case xzCompression:
+		var xr *xz.Reader
+		xr, err = xz.NewReader(bytes.NewReader(src))
+		if err != nil {
+			return nil, err
+		}
+		b, err = io.ReadAll(io.LimitReader(xr, int64(limit)+1))
+
+	case lz4Compression:
+		b = make([]byte, limit)
+		var n int
+		n, err = lz4.UncompressBlock(src, b)
+		b = b[:n]
+
+	case zstdCompression:
+		zstdDecoderOnce.Do(func() {
+			zstdDecoder, zstdDecoderErr = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+		})
+		if zstdDecoderErr != nil {
+			return nil, zstdDecoderErr
+		}
+		b, err = zstdDecoder.DecodeAll(src, make([]byte, 0, limit))
+
+	default:
+		return nil, fmt.Errorf("unsupported compression %d", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > limit {
+		return nil, fmt.Errorf("decompressed size exceeds %d bytes", limit)
+	}
+	return b, nil
+}
+
+// supportedCompression reports whether decompress supports compression id.
+func supportedCompression(id uint16) bool {
+	switch id {
+	case zlibCompression, xzCompression, lz4Compression, zstdCompression:
+		return true
+	}
+	return false
+}
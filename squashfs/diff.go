@@ -0,0 +1,225 @@
+package squashfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"sort"
+	"time"
+)
+
+// ChangeKind is the kind of a Change.
+type ChangeKind string
+
+const (
+	Added    ChangeKind = "added"
+	Removed  ChangeKind = "removed"
+	Modified ChangeKind = "modified"
+)
+
+// DiffEntry describes a file system entry as compared by Diff.
+type DiffEntry struct {
+	// Mode contains the type and permission bits. It is encoded as a string
+	// (e.g. "-rwxr-xr-x") in JSON.
+	Mode    fs.FileMode `json:"mode"`
+	Uid     uint32      `json:"uid"`
+	Gid     uint32      `json:"gid"`
+	ModTime time.Time   `json:"mtime"`
+
+	// Size is the size of regular files, and 0 for all other types.
+	Size int64 `json:"size"`
+
+	// Target is the target of symbolic links.
+	Target string `json:"target,omitempty"`
+
+	// Rdev is the device number of block and character devices.
+	Rdev uint32 `json:"rdev,omitempty"`
+
+	// Xattrs are the extended attributes, sorted by name.
+	Xattrs []Xattr `json:"xattrs,omitempty"`
+
+	// sum is the SHA-256 hash of the contents of regular files.
+	sum [sha256.Size]byte
+}
+
+func (e *DiffEntry) MarshalJSON() ([]byte, error) {
+	type entry DiffEntry // without the MarshalJSON method
+	return json.Marshal(struct {
+		*entry
+		Mode string `json:"mode"`
+	}{
+		entry: (*entry)(e),
+		Mode:  e.Mode.String(),
+	})
+}
+
+// Change describes how a file system entry differs between two images, see
+// Diff.
+type Change struct {
+	// Path is the path of the entry, e.g. "/usr/bin/x" ("/" for the root
+	// directory).
+	Path string     `json:"path"`
+	Kind ChangeKind `json:"kind"`
+
+	// Old and New describe the entry in the old and new image, respectively.
+	// Old is nil for added entries, New is nil for removed entries.
+	Old *DiffEntry `json:"old,omitempty"`
+	New *DiffEntry `json:"new,omitempty"`
+
+	// Fields lists the changed attributes of modified entries: "type",
+	// "mode", "owner", "mtime", "target", "rdev", "xattrs", "size" and
+	// "contents".
+	Fields []string `json:"fields,omitempty"`
+
+	// SizeDelta is the change in size of regular files, i.e. the size of
+	// added files, the negative size of removed files, and the difference
+	// for modified files.
+	SizeDelta int64 `json:"size_delta"`
+}
+
+// DiffOptions configures Diff.
+type DiffOptions struct {
+	// ModTime enables comparing modification times, which usually differ
+	// between builds unless WithClampTime is used.
+	ModTime bool
+}
+
+// Diff compares the images read by oldImage and newImage and returns the
+// changes (sorted by path) which turn the old into the new image. Hard links
+// are compared like separate files.
+func Diff(oldImage, newImage *Reader, opts DiffOptions) ([]Change, error) {
+	oldEntries, err := oldImage.diffEntries()
+	if err != nil {
+		return nil, err
+	}
+	newEntries, err := newImage.diffEntries()
+	if err != nil {
+		return nil, err
+	}
+	var changes []Change
+	for p, oe := range oldEntries {
+		ne, ok := newEntries[p]
+		if !ok {
+			changes = append(changes, Change{
+				Path:      p,
+				Kind:      Removed,
+				Old:       oe,
+				SizeDelta: -oe.Size,
+			})
+			continue
+		}
+		if fields := oe.diff(ne, opts); len(fields) > 0 {
+			changes = append(changes, Change{
+				Path:      p,
+				Kind:      Modified,
+				Old:       oe,
+				New:       ne,
+				Fields:    fields,
+				SizeDelta: ne.Size - oe.Size,
+			})
+		}
+	}
+	for p, ne := range newEntries {
+		if _, ok := oldEntries[p]; !ok {
+			changes = append(changes, Change{
+				Path:      p,
+				Kind:      Added,
+				New:       ne,
+				SizeDelta: ne.Size,
+			})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes, nil
+}
+
+// diff returns the names of the attributes which differ between e and other.
+func (e *DiffEntry) diff(other *DiffEntry, opts DiffOptions) []string {
+	var fields []string
+	if e.Mode.Type() != other.Mode.Type() {
+		// None of the other attributes are comparable.
+		return []string{"type"}
+	}
+	if e.Mode != other.Mode {
+		fields = append(fields, "mode")
+	}
+	if e.Uid != other.Uid || e.Gid != other.Gid {
+		fields = append(fields, "owner")
+	}
+	if opts.ModTime && !e.ModTime.Equal(other.ModTime) {
+		fields = append(fields, "mtime")
+	}
+	if e.Target != other.Target {
+		fields = append(fields, "target")
+	}
+	if e.Rdev != other.Rdev {
+		fields = append(fields, "rdev")
+	}
+	if !slices.EqualFunc(e.Xattrs, other.Xattrs, func(a, b Xattr) bool {
+		return a.Name == b.Name && bytes.Equal(a.Value, b.Value)
+	}) {
+		fields = append(fields, "xattrs")
+	}
+	if e.Size != other.Size {
+		fields = append(fields, "size")
+	} else if e.sum != other.sum {
+		fields = append(fields, "contents")
+	}
+	return fields
+}
+
+// diffEntries returns all entries of the image, keyed by path.
+func (r *Reader) diffEntries() (map[string]*DiffEntry, error) {
+	entries := make(map[string]*DiffEntry)
+	err := fs.WalkDir(r, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		st := info.Sys().(*Stat)
+		e := &DiffEntry{
+			Mode:    info.Mode(),
+			Uid:     st.Uid,
+			Gid:     st.Gid,
+			ModTime: info.ModTime(),
+			Rdev:    st.Rdev,
+		}
+		if e.Xattrs, err = r.Xattrs(name); err != nil {
+			return err
+		}
+		switch info.Mode().Type() {
+		case 0: // regular file
+			e.Size = info.Size()
+			if e.sum, err = r.sum(name, info.(*fileInfo)); err != nil {
+				return err
+			}
+		case fs.ModeSymlink:
+			if e.Target, err = r.ReadLink(name); err != nil {
+				return err
+			}
+		}
+		entries[path.Join("/", name)] = e
+		return nil
+	})
+	return entries, err
+}
+
+// sum returns the SHA-256 hash of the contents of the regular file fi, which
+// is located at path name.
+func (r *Reader) sum(name string, fi *fileInfo) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+	h := sha256.New()
+	if _, err := io.Copy(h, &openFile{r: r, fi: fi, path: name}); err != nil {
+		return sum, fmt.Errorf("%s: %v", name, err)
+	}
+	h.Sum(sum[:0])
+	return sum, nil
+}
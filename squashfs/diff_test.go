@@ -0,0 +1,126 @@
+package squashfs
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDiff(t *testing.T) {
+	t.Parallel()
+
+	mtime := time.Unix(1234567890, 0)
+	build := func(fill func(w *Writer)) *Reader {
+		f := writeTestImage(t, fill)
+		r, err := NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	addFile := func(w *Writer, name string, mode os.FileMode, contents string, opts ...EntryOption) {
+		t.Helper()
+		f, err := w.AddFile(name, mtime, mode, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte(contents)); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	addSymlink := func(w *Writer, target, name string) {
+		t.Helper()
+		if err := w.AddSymlink(target, name, mtime, 0o777); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	oldImage := build(func(w *Writer) {
+		addFile(w, "/etc/hostname", 0o644, "gokrazy\n")
+		addFile(w, "/etc/removed", 0o644, "bye")
+		addFile(w, "/usr/bin/contents", 0o755, "version 1")
+		addFile(w, "/usr/bin/mode", 0o755, "x")
+		addFile(w, "/usr/bin/owner", 0o755, "x")
+		addFile(w, "/usr/bin/size", 0o755, "small")
+		addFile(w, "/usr/bin/type", 0o755, "x")
+		addSymlink(w, "/usr/bin/size", "/usr/bin/link")
+	})
+	newImage := build(func(w *Writer) {
+		addFile(w, "/etc/hostname", 0o644, "gokrazy\n")
+		addFile(w, "/etc/added", 0o644, "hello")
+		addFile(w, "/usr/bin/contents", 0o755, "version 2")
+		addFile(w, "/usr/bin/mode", 0o700, "x")
+		addFile(w, "/usr/bin/owner", 0o755, "x", WithOwner(1000, 1000))
+		addFile(w, "/usr/bin/size", 0o755, "much larger")
+		if err := w.AddDirectory("/usr/bin/type", mtime, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		addSymlink(w, "/usr/bin/mode", "/usr/bin/link")
+	})
+
+	changes, err := Diff(oldImage, newImage, DiffOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	type summary struct {
+		Path      string
+		Kind      ChangeKind
+		Fields    []string
+		SizeDelta int64
+	}
+	var got []summary
+	for _, c := range changes {
+		got = append(got, summary{c.Path, c.Kind, c.Fields, c.SizeDelta})
+	}
+	want := []summary{
+		{"/etc/added", Added, nil, 5},
+		{"/etc/removed", Removed, nil, -3},
+		{"/usr/bin/contents", Modified, []string{"contents"}, 0},
+		{"/usr/bin/link", Modified, []string{"target"}, 0},
+		{"/usr/bin/mode", Modified, []string{"mode"}, 0},
+		{"/usr/bin/owner", Modified, []string{"owner"}, 0},
+		{"/usr/bin/size", Modified, []string{"size"}, 6},
+		{"/usr/bin/type", Modified, []string{"type"}, -1},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Diff: unexpected changes (-want +got):\n%s", diff)
+	}
+
+	changes, err = Diff(oldImage, oldImage, DiffOptions{ModTime: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) > 0 {
+		t.Errorf("Diff(old, old) = %+v, want no changes", changes)
+	}
+
+	b, err := json.Marshal(Change{
+		Path: "/usr/bin/mode",
+		Kind: Modified,
+		Old:  &DiffEntry{Mode: 0o755},
+		New: &DiffEntry{
+			Mode:   0o700,
+			Xattrs: []Xattr{{Name: "user.origin", Value: []byte("gokrazy")}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`"mode":"-rwxr-xr-x"`,
+		`"mode":"-rwx------"`,
+		`"kind":"modified"`,
+		`"xattrs":[{"name":"user.origin","value":"Z29rcmF6eQ=="}]`,
+	} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("json.Marshal(Change) = %s, want it to contain %s", b, want)
+		}
+	}
+}
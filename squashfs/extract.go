@@ -0,0 +1,168 @@
+package squashfs
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ExtractOptions configures Extract.
+type ExtractOptions struct {
+	// Path is the slash-separated path of the subtree to extract, e.g.
+	// "usr/share/zoneinfo". By default, the whole image is extracted. If
+	// Path refers to a directory, its contents are extracted to the
+	// destination directory, otherwise the file is extracted into the
+	// destination directory.
+	Path string
+
+	// Owner enables setting the owner of extracted files to the uid and gid
+	// stored in the image, which usually requires root privileges.
+	Owner bool
+}
+
+// Extract extracts the files, directories and symbolic links of the image
+// read by r to the directory dest (which is created if necessary), keeping
+// their modes and modification times. Hard links are extracted as separate
+// files. Device nodes, named pipes and sockets are skipped. When extracting
+// the whole image, dest gets the mode and modification time (and owner) of the
+// root directory.
+//
+// Entries must not exist in dest yet: Extract never replaces existing files
+// and never follows symbolic links within dest. Entry names which could
+// escape dest (e.g. "..") result in an error.
+func Extract(r *Reader, dest string, opts ExtractOptions) error {
+	name := strings.Trim(path.Clean("/"+opts.Path), "/")
+	if name == "" {
+		name = "."
+	}
+	fi, err := r.Lstat(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dest, 0o755); err != nil {
+		return err
+	}
+	x := &extractor{r: r, opts: opts}
+	if fi.IsDir() {
+		if err := x.extractDir(name, dest); err != nil {
+			return err
+		}
+		if name != "." {
+			return nil
+		}
+		return x.setAttributes(dest, fi)
+	}
+	return x.extract(name, filepath.Join(dest, fi.Name()), fi)
+}
+
+type extractor struct {
+	r    *Reader
+	opts ExtractOptions
+}
+
+// validName reports whether name is a directory entry name which can be
+// safely joined to a host path.
+func validName(name string) bool {
+	return name != "" &&
+		name != "." &&
+		name != ".." &&
+		!strings.ContainsAny(name, `/\`) &&
+		filepath.IsLocal(name)
+}
+
+// extractDir extracts the contents of the directory name to the existing
+// host directory dir.
+func (x *extractor) extractDir(name, dir string) error {
+	entries, err := x.r.ReadDir(name)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !validName(e.Name()) {
+			return fmt.Errorf("squashfs: %s: invalid directory entry name %q", name, e.Name())
+		}
+		fi, err := e.Info()
+		if err != nil {
+			return err
+		}
+		if err := x.extract(path.Join(name, e.Name()), filepath.Join(dir, e.Name()), fi); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extract extracts the entry name (described by fi) to the host path dst.
+func (x *extractor) extract(name, dst string, fi fs.FileInfo) error {
+	switch fi.Mode().Type() {
+	case fs.ModeDir:
+		// Create the directory with restrictive permissions until its
+		// contents are extracted, in case it is not writable.
+		if err := os.Mkdir(dst, 0o700); err != nil {
+			return err
+		}
+		if err := x.extractDir(name, dst); err != nil {
+			return err
+		}
+
+	case fs.ModeSymlink:
+		target, err := x.r.ReadLink(name)
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(target, dst); err != nil {
+			return err
+		}
+
+	case 0: // regular file
+		if err := x.extractFile(name, dst); err != nil {
+			return err
+		}
+
+	default:
+		return nil // special files are skipped
+	}
+	return x.setAttributes(dst, fi)
+}
+
+func (x *extractor) extractFile(name, dst string) error {
+	in, err := x.r.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	// O_EXCL ensures that dst is neither an existing file nor a symbolic link.
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		return fmt.Errorf("squashfs: %s: %v", name, err)
+	}
+	return out.Close()
+}
+
+// setAttributes sets the owner (if enabled), mode and modification time of
+// dst as described by fi. Symbolic links only get their owner set, as their
+// mode cannot be changed on Linux.
+func (x *extractor) setAttributes(dst string, fi fs.FileInfo) error {
+	if x.opts.Owner {
+		st := fi.Sys().(*Stat)
+		if err := os.Lchown(dst, int(st.Uid), int(st.Gid)); err != nil {
+			return err
+		}
+	}
+	if fi.Mode().Type() == fs.ModeSymlink {
+		return nil
+	}
+	// Chmod after Lchown, which clears the setuid and setgid bits.
+	if err := os.Chmod(dst, fi.Mode()&(fs.ModePerm|fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky)); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, fi.ModTime(), fi.ModTime())
+}
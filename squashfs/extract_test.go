@@ -0,0 +1,175 @@
+package squashfs
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExtract(t *testing.T) {
+	t.Parallel()
+
+	mtime := time.Unix(1234567890, 0)
+	f := writeTestImage(t, func(w *Writer) {
+		if err := w.AddDirectory("/etc/ssl", mtime, 0o555); err != nil {
+			t.Fatal(err)
+		}
+		for _, file := range []struct {
+			name     string
+			mode     os.FileMode
+			contents string
+		}{
+			{"/etc/hostname", 0o644, "gokrazy\n"},
+			{"/etc/ssl/ca-bundle.pem", 0o444, "certificates"},
+			{"/usr/bin/su", 0o755 | os.ModeSetuid, "#!/bin/sh\n"},
+		} {
+			ff, err := w.AddFile(file.name, mtime, file.mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ff.Write([]byte(file.contents)); err != nil {
+				t.Fatal(err)
+			}
+			if err := ff.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.AddSymlink("/etc/hostname", "/etc/hostname.link", mtime, 0o777); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.AddLink("/usr/bin/sudo", "/usr/bin/su"); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.AddFifo("/dev/fifo", mtime, os.ModeNamedPipe|0o600); err != nil {
+			t.Fatal(err)
+		}
+	})
+	r, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dest := filepath.Join(t.TempDir(), "root")
+	t.Cleanup(func() {
+		// Allow removing the contents of read-only directories.
+		os.Chmod(filepath.Join(dest, "etc", "ssl"), 0o755)
+	})
+	if err := Extract(r, dest, ExtractOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []struct {
+		name     string
+		mode     fs.FileMode
+		contents string
+	}{
+		{"etc/hostname", 0o644, "gokrazy\n"},
+		{"etc/ssl", fs.ModeDir | 0o555, ""},
+		{"etc/ssl/ca-bundle.pem", 0o444, "certificates"},
+		{"usr/bin/su", 0o755 | fs.ModeSetuid, "#!/bin/sh\n"},
+		{"usr/bin/sudo", 0o755 | fs.ModeSetuid, "#!/bin/sh\n"},
+	} {
+		p := filepath.Join(dest, filepath.FromSlash(want.name))
+		fi, err := os.Lstat(p)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if got := fi.Mode(); got != want.mode {
+			t.Errorf("%s: mode = %v, want %v", want.name, got, want.mode)
+		}
+		if got := fi.ModTime(); !got.Equal(mtime) {
+			t.Errorf("%s: mtime = %v, want %v", want.name, got, mtime)
+		}
+		if fi.IsDir() {
+			continue
+		}
+		b, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != want.contents {
+			t.Errorf("%s: contents = %q, want %q", want.name, got, want.contents)
+		}
+	}
+	if got, err := os.Readlink(filepath.Join(dest, "etc", "hostname.link")); err != nil || got != "/etc/hostname" {
+		t.Errorf("Readlink(etc/hostname.link) = %q, %v, want %q", got, err, "/etc/hostname")
+	}
+	if _, err := os.Lstat(filepath.Join(dest, "dev", "fifo")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Lstat(dev/fifo) = %v, want fs.ErrNotExist (special files are skipped)", err)
+	}
+
+	// Existing files are never replaced.
+	if err := Extract(r, dest, ExtractOptions{}); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("Extract to a non-empty directory: got %v, want fs.ErrExist", err)
+	}
+
+	// Extract a subtree and a single file.
+	subtree := t.TempDir()
+	if err := Extract(r, subtree, ExtractOptions{Path: "/usr/bin"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Extract(r, subtree, ExtractOptions{Path: "etc/hostname"}); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(subtree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if got, want := names, []string{"hostname", "su", "sudo"}; len(got) != len(want) || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+		t.Errorf("extracted subtree contains %v, want %v", got, want)
+	}
+}
+
+func TestExtractTraversal(t *testing.T) {
+	t.Parallel()
+
+	for _, name := range []string{"..", `..\evil`} {
+		// The Writer rejects such names, so write a placeholder name and patch
+		// the directory table (Check rejects such images, too).
+		placeholder := strings.Repeat("x", len(name))
+		dir := t.TempDir()
+		f, err := os.Create(filepath.Join(dir, "squashfs"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		w, err := NewWriter(f, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeTestFile(t, w.Root, placeholder, 0o644, []byte("evil"))
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		r, err := NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := readTestImage(t, f)
+		dirTable := b[r.sb.DirectoryTableStart:r.sb.FragmentTableStart]
+		copy(dirTable, bytes.Replace(dirTable, []byte(placeholder), []byte(name), 1))
+		if r, err = NewReader(bytes.NewReader(b)); err != nil {
+			t.Fatal(err)
+		}
+		dest := filepath.Join(dir, "dest")
+		if err := Extract(r, dest, ExtractOptions{}); err == nil {
+			t.Errorf("Extract of an image containing %q unexpectedly succeeded", name)
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 2 { // squashfs, dest
+			t.Errorf("Extract of an image containing %q created files outside of the destination: %v", name, entries)
+		}
+	}
+}
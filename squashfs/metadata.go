@@ -0,0 +1,181 @@
+package squashfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// metadataWriter accumulates a metadata table (the inode table or the
+// directory table). Each metadataBlockSize chunk is encoded (and possibly
+// compressed) as soon as it is complete, so that references into the table
+// (on-disk block offset + offset within the uncompressed block) are known at
+// the time an entry is written.
+type metadataWriter struct {
+	w *Writer
+
+	// cur holds the uncompressed contents of the current block.
+	cur bytes.Buffer
+
+	// out holds all completed blocks in their on-disk encoding.
+	out spillBuffer
+
+	// size is the total number of uncompressed bytes written.
+	size int64
+}
+
+// ref returns the location at which the next Write will start: the on-disk
+// offset of the current block (relative to the start of the table) and the
+// offset within the uncompressed block.
+func (mw *metadataWriter) ref() (block uint32, offset uint16) {
+	return uint32(mw.out.size), uint16(mw.cur.Len())
+}
+
+// Write implements io.Writer
+func (mw *metadataWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		chunk := p
+		if free := metadataBlockSize - mw.cur.Len(); len(chunk) > free {
+			chunk = chunk[:free]
+		}
+		mw.cur.Write(chunk)
+		n += len(chunk)
+		mw.size += int64(len(chunk))
+		p = p[len(chunk):]
+		if mw.cur.Len() == metadataBlockSize {
+			if err := mw.flushBlock(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (mw *metadataWriter) flushBlock() error {
+	if mw.cur.Len() == 0 {
+		return nil
+	}
+	if err := mw.w.writeMetadataBlock(&mw.out, mw.cur.Bytes()); err != nil {
+		return err
+	}
+	mw.cur.Reset()
+	if mw.out.size > math.MaxUint32 {
+		// References into the table (e.g. in directory headers) store the
+		// block offset as uint32.
+		return fmt.Errorf("squashfs: metadata table exceeds 4 GiB")
+	}
+	return nil
+}
+
+// WriteTo writes the table to w, encoding the final partial block.
+func (mw *metadataWriter) WriteTo(w io.Writer) (int64, error) {
+	if err := mw.flushBlock(); err != nil {
+		return 0, err
+	}
+	n, err := mw.out.WriteTo(w)
+	if err != nil {
+		return n, err
+	}
+	return n, mw.out.Close()
+}
+
+// spillBuffer is an append-only buffer which keeps its contents in memory
+// until they exceed limit bytes (if limit is positive), at which point they
+// are moved to a temporary file in dir (os.TempDir if empty).
+type spillBuffer struct {
+	limit int64
+	dir   string
+
+	mem bytes.Buffer
+	f   *os.File
+
+	// size is the total number of bytes written.
+	size int64
+}
+
+// Write implements io.Writer
+func (b *spillBuffer) Write(p []byte) (int, error) {
+	if b.f == nil && b.limit > 0 && b.size+int64(len(p)) > b.limit {
+		if err := b.spill(); err != nil {
+			return 0, err
+		}
+	}
+	var (
+		n   int
+		err error
+	)
+	if b.f != nil {
+		n, err = b.f.Write(p)
+	} else {
+		n, err = b.mem.Write(p)
+	}
+	b.size += int64(n)
+	return n, err
+}
+
+// spill moves the in-memory contents to a temporary file.
+func (b *spillBuffer) spill() error {
+	f, err := os.CreateTemp(b.dir, "squashfs-metadata-")
+	if err != nil {
+		return err
+	}
+	b.f = f
+	if _, err := b.mem.WriteTo(f); err != nil {
+		return err
+	}
+	b.mem = bytes.Buffer{} // release memory
+	return nil
+}
+
+// WriteTo writes the contents of the buffer to w.
+func (b *spillBuffer) WriteTo(w io.Writer) (int64, error) {
+	if b.f == nil {
+		return b.mem.WriteTo(w)
+	}
+	if _, err := b.f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.Copy(w, b.f)
+}
+
+// Close removes the temporary file, if any.
+func (b *spillBuffer) Close() error {
+	if b.f == nil {
+		return nil
+	}
+	f := b.f
+	b.f = nil
+	err := f.Close()
+	if rerr := os.Remove(f.Name()); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// writeMetadataBlock writes block (at most metadataBlockSize bytes) to dst,
+// prefixed with a uint16 length header. If metadata compression is enabled
+// and the block compresses, the compressed block is written, otherwise the
+// uncompressed bit is set.
+func (w *Writer) writeMetadataBlock(dst io.Writer, block []byte) error {
+	if w.compressMetadata {
+		compressed, err := w.compress(block)
+		if err != nil {
+			return err
+		}
+		if len(compressed) < len(block) {
+			if err := binary.Write(dst, binary.LittleEndian, uint16(len(compressed))); err != nil {
+				return err
+			}
+			_, err := dst.Write(compressed)
+			return err
+		}
+	}
+	if err := binary.Write(dst, binary.LittleEndian, uint16(len(block))|0x8000); err != nil {
+		return err
+	}
+	_, err := dst.Write(block)
+	return err
+}
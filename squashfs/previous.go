@@ -0,0 +1,175 @@
+package squashfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+)
+
+// WithPreviousImage builds the image incrementally, based on the previous
+// version of the image read from r (which must have been created with the
+// same Compressor): the data area of the previous image (all data and
+// fragment blocks) is copied verbatim to the start of the new image, and
+// files whose contents are identical to a file of the previous image (at any
+// path) refer to the existing blocks. Only the data of new or modified files
+// is appended, followed by the metadata, which is always written from scratch.
+//
+// This way, most of the new image is byte-identical to the previous image,
+// so that a block-level delta transfer (e.g. to the inactive root partition)
+// only needs to send the changed regions at the end of the image.
+//
+// The data of files which were removed or modified remains in the image, but
+// is no longer referenced. To bound the growth over successive incremental
+// builds, Flush returns an *UnreferencedError if the unreferenced data
+// (including data which was already unreferenced in the previous image)
+// exceeds maxUnreferenced (e.g. 0.1 for 10%) of the data area. The image then
+// needs to be built without WithPreviousImage.
+//
+// The contents of all files of the previous image are read (and hashed) in
+// NewWriter.
+func WithPreviousImage(r io.ReaderAt, maxUnreferenced float64) Option {
+	return func(w *Writer) {
+		w.previous = r
+		w.maxUnreferenced = maxUnreferenced
+	}
+}
+
+// UnreferencedError is returned by Writer.Flush if too much of the data copied
+// from the previous image is no longer referenced, see WithPreviousImage.
+type UnreferencedError struct {
+	// Unreferenced is the number of bytes of data which are not referenced.
+	Unreferenced int64
+
+	// DataSize is the size of the data area in bytes.
+	DataSize int64
+
+	// MaxUnreferenced is the maximum share of unreferenced data, as passed to
+	// WithPreviousImage.
+	MaxUnreferenced float64
+}
+
+func (e *UnreferencedError) Error() string {
+	return fmt.Sprintf("squashfs: %d of %d bytes of data (%.1f%%) are no longer referenced, exceeding the maximum of %.1f%%: build the image without the previous image",
+		e.Unreferenced, e.DataSize, 100*float64(e.Unreferenced)/float64(e.DataSize), 100*e.MaxUnreferenced)
+}
+
+// reusePrevious copies the data area of w.previous to the underlying writer,
+// which must be positioned at the start of the data area, and registers the
+// contents of all files for de-duplication.
+func (w *Writer) reusePrevious() error {
+	prev, err := NewReader(w.previous)
+	if err != nil {
+		return fmt.Errorf("squashfs: reading previous image: %v", err)
+	}
+	if prev.sb.Compression != w.sb.Compression || prev.sb.BlockSize != w.sb.BlockSize {
+		return fmt.Errorf("squashfs: previous image uses compression %d with block size %d, want compression %d with block size %d",
+			prev.sb.Compression, prev.sb.BlockSize, w.sb.Compression, w.sb.BlockSize)
+	}
+	// Compressor-specific options (if any) precede the data area and must be
+	// identical for the data area to start at the same offset.
+	const compopt = 1 << 10
+	var prevOpts []byte
+	if prev.sb.Flags&compopt != 0 {
+		var hdr uint16
+		if err := binary.Read(io.NewSectionReader(w.previous, 96, 2), binary.LittleEndian, &hdr); err != nil {
+			return fmt.Errorf("squashfs: reading previous image: %v", err)
+		}
+		prevOpts = make([]byte, hdr&^0x8000)
+		if _, err := w.previous.ReadAt(prevOpts, 96+2); err != nil {
+			return fmt.Errorf("squashfs: reading previous image: %v", err)
+		}
+	}
+	if !bytes.Equal(prevOpts, w.compressor.Options()) {
+		return fmt.Errorf("squashfs: previous image uses different compressor options")
+	}
+
+	dataStart := w.dataEnd
+	if prev.sb.InodeTableStart < dataStart {
+		return fmt.Errorf("squashfs: previous image: invalid inode table start %d", prev.sb.InodeTableStart)
+	}
+	n, err := io.Copy(w.w, io.NewSectionReader(w.previous, dataStart, prev.sb.InodeTableStart-dataStart))
+	if err != nil {
+		return err
+	}
+	w.dataEnd += n
+	w.fragments = append(w.fragments, prev.fragments...)
+	w.previousStart = dataStart
+	w.previousEnd = w.dataEnd
+	w.previousUsed = make(map[[sha256.Size]byte]bool)
+
+	return fs.WalkDir(prev, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		// The DirEntry refers to the inode directly, which avoids looking up
+		// each path in the (possibly large) directories again.
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		fi := info.(*fileInfo)
+		ino := fi.ino
+		if ino.size == 0 {
+			return nil // empty files are not de-duplicated
+		}
+		sum, err := prev.sum(name, fi)
+		if err != nil {
+			return fmt.Errorf("squashfs: reading previous image: %v", err)
+		}
+		if _, ok := w.dataByHash[sum]; ok {
+			return nil
+		}
+		w.dataByHash[sum] = fileData{
+			startBlock: ino.startBlock,
+			blocksizes: ino.blockSizes,
+			fragment:   ino.fragment,
+			fragOffset: ino.fragOffset,
+			sparse:     ino.sparse,
+			previous:   true,
+		}
+		w.maxDataSize = max(w.maxDataSize, ino.size)
+		return nil
+	})
+}
+
+// checkUnreferenced returns an *UnreferencedError if too much of the data area
+// is unreferenced, i.e. data copied from the previous image which is not used
+// by any file of the new image. Fragment blocks count as referenced if any
+// file uses them.
+func (w *Writer) checkUnreferenced() error {
+	if w.previous == nil {
+		return nil
+	}
+	var (
+		referenced int64
+		fragments  = make(map[uint32]bool)
+	)
+	for sum := range w.previousUsed {
+		data := w.dataByHash[sum]
+		for _, size := range data.blocksizes {
+			referenced += int64(size &^ (1 << 24))
+		}
+		if data.fragment != invalidFragment {
+			fragments[data.fragment] = true
+		}
+	}
+	for idx := range fragments {
+		referenced += int64(w.fragments[idx].Size &^ (1 << 24))
+	}
+	unreferenced := w.previousEnd - w.previousStart - referenced
+	size := w.dataEnd - w.previousStart
+	if unreferenced > 0 && float64(unreferenced) > w.maxUnreferenced*float64(size) {
+		return &UnreferencedError{
+			Unreferenced:    unreferenced,
+			DataSize:        size,
+			MaxUnreferenced: w.maxUnreferenced,
+		}
+	}
+	return nil
+}
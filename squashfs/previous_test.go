@@ -0,0 +1,179 @@
+package squashfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readTestImage(t *testing.T, f *os.File) []byte {
+	t.Helper()
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestPreviousImage(t *testing.T) {
+	t.Parallel()
+
+	rnd := rand.New(rand.NewSource(1))
+	contents := make(map[string][]byte)
+	for i := 0; i < 10; i++ {
+		// multiple blocks, with a tail in a fragment block
+		b := make([]byte, 3*dataBlockSize+i*1000)
+		rnd.Read(b[:len(b)/2])
+		contents[fmt.Sprintf("bin/prog%d", i)] = b
+	}
+	contents["etc/hostname"] = []byte("gokrazy\n")
+	contents["etc/empty"] = nil
+
+	build := func(contents map[string][]byte, opts ...Option) []byte {
+		f := writeTestImage(t, func(w *Writer) {
+			for i := 0; i < 10; i++ {
+				name := fmt.Sprintf("bin/prog%d", i)
+				if b, ok := contents[name]; ok {
+					writeTestFile(t, w.Root, strings.ReplaceAll(name, "/", "-"), 0o755, b)
+				}
+			}
+			for _, name := range []string{"etc/empty", "etc/hostname", "new"} {
+				if b, ok := contents[name]; ok {
+					writeTestFile(t, w.Root, strings.ReplaceAll(name, "/", "-"), 0o644, b)
+				}
+			}
+		}, opts...)
+		return readTestImage(t, f)
+	}
+	prev := build(contents)
+	prevReader, err := NewReader(bytes.NewReader(prev))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataEnd := prevReader.sb.InodeTableStart
+
+	// Modify a file at the start of the image, remove one and add one.
+	next := make(map[string][]byte)
+	for name, b := range contents {
+		next[name] = b
+	}
+	next["bin/prog0"] = bytes.Repeat([]byte("modified"), dataBlockSize/2)
+	delete(next, "bin/prog5")
+	next["new"] = []byte("new file\n")
+
+	img := build(next, WithPreviousImage(bytes.NewReader(prev), 0.5))
+	if !bytes.Equal(img[96:dataEnd], prev[96:dataEnd]) {
+		t.Errorf("data area of the previous image was not preserved")
+	}
+	// The modified and new files are appended: about one block compressed
+	// data plus metadata.
+	if growth := int64(len(img)) - dataEnd; growth > 2*dataBlockSize {
+		t.Errorf("image grew by %d bytes beyond the previous data area, want at most %d", growth, 2*dataBlockSize)
+	}
+
+	r, err := NewReader(bytes.NewReader(img))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range next {
+		got, err := fs.ReadFile(r, strings.ReplaceAll(name, "/", "-"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: contents differ", name)
+		}
+	}
+	if _, err := r.Stat("bin-prog5"); err == nil {
+		t.Errorf("removed file bin-prog5 unexpectedly present")
+	}
+
+	// Two of ten files were removed or modified, so about a fifth of the
+	// data area is unreferenced.
+	f, err := os.Create(t.TempDir() + "/squashfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w, err := NewWriter(f, time.Now(), WithPreviousImage(bytes.NewReader(prev), 0.1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, b := range next {
+		writeTestFile(t, w.Root, strings.ReplaceAll(name, "/", "-"), 0o644, b)
+	}
+	err = w.Flush()
+	var uerr *UnreferencedError
+	if !errors.As(err, &uerr) {
+		t.Fatalf("Flush with at most 10%% unreferenced data: got error %v, want an *UnreferencedError", err)
+	}
+	if share := float64(uerr.Unreferenced) / float64(uerr.DataSize); share < 0.1 || share > 0.3 {
+		t.Errorf("UnreferencedError = %+v (%.2f unreferenced), want between 0.1 and 0.3", uerr, share)
+	}
+
+	// A different compressor cannot re-use the data blocks.
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewWriter(f, time.Now(), WithPreviousImage(bytes.NewReader(prev), 0.5), WithCompressor(Zstd(3))); err == nil {
+		t.Errorf("NewWriter with a different compressor unexpectedly succeeded")
+	}
+}
+
+// BenchmarkPreviousImage measures hashing the files of a previous image with
+// many small (compressible) files, which share fragment blocks.
+func BenchmarkPreviousImage(b *testing.B) {
+	var prev bytes.Buffer
+	f, err := os.Create(b.TempDir() + "/previous")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+	w, err := NewWriter(f, time.Now())
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		name := fmt.Sprintf("file%04d", i)
+		ff, err := w.Root.File(name, time.Now(), 0o644)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := ff.Write(bytes.Repeat([]byte(name), 500)); err != nil {
+			b.Fatal(err)
+		}
+		if err := ff.Close(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		b.Fatal(err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		b.Fatal(err)
+	}
+	if _, err := io.Copy(&prev, f); err != nil {
+		b.Fatal(err)
+	}
+
+	out, err := os.Create(b.TempDir() + "/squashfs")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer out.Close()
+	for b.Loop() {
+		if _, err := NewWriter(out, time.Now(), WithPreviousImage(bytes.NewReader(prev.Bytes()), 0.5)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
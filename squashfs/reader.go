@@ -0,0 +1,988 @@
+package squashfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reader reads SquashFS file system images, such as those created by
+// Writer. Reader implements fs.FS, fs.ReadDirFS and fs.StatFS, so images can
+// be inspected using the standard library (e.g. fs.WalkDir).
+//
+// Like Writer, Reader only implements a subset of SquashFS: the lzma and lzo
+// compression algorithms are not supported.
+type Reader struct {
+	r  io.ReaderAt
+	sb superblock
+
+	ids       []uint32
+	fragments []fragmentEntry
+
+	mu         sync.Mutex
+	metaBlocks map[int64]metadataBlock
+	// lastFragment holds the most recently read fragment block (index
+	// lastFragmentIdx), which is typically shared by consecutive small files.
+	lastFragmentIdx uint32
+	lastFragment    []byte
+}
+
+// metadataBlock is a decompressed metadata block.
+type metadataBlock struct {
+	data []byte
+	// next is the absolute offset of the next metadata block.
+	next int64
+}
+
+// NewReader returns a Reader which reads the SquashFS file system image from
+// r. The superblock, id table and fragment table are read immediately, all
+// other data is read on demand.
+func NewReader(r io.ReaderAt) (*Reader, error) {
+	rd := &Reader{
+		r:          r,
+		metaBlocks: make(map[int64]metadataBlock),
+	}
+	if err := binary.Read(io.NewSectionReader(r, 0, 96), binary.LittleEndian, &rd.sb); err != nil {
+		return nil, fmt.Errorf("reading superblock: %v", err)
+	}
+	if got, want := rd.sb.Magic, uint32(magic); got != want {
+		return nil, fmt.Errorf("invalid magic: got %#x, want %#x", got, want)
+	}
+	if rd.sb.Major != majorVersion {
+		return nil, fmt.Errorf("unsupported SquashFS version %d.%d", rd.sb.Major, rd.sb.Minor)
+	}
+	if rd.sb.BlockLog > 20 || rd.sb.BlockSize != 1<<rd.sb.BlockLog {
+		return nil, fmt.Errorf("invalid block size %d (block log %d)", rd.sb.BlockSize, rd.sb.BlockLog)
+	}
+	if !supportedCompression(rd.sb.Compression) {
+		return nil, fmt.Errorf("unsupported compression %d", rd.sb.Compression)
+	}
+
+	// All table sizes below are derived from the superblock, so verify that
+	// bytes_used lies within the image before using it to bound them.
+	if rd.sb.BytesUsed < 96 {
+		return nil, fmt.Errorf("invalid bytes_used %d", rd.sb.BytesUsed)
+	}
+	if _, err := r.ReadAt(make([]byte, 1), rd.sb.BytesUsed-1); err != nil {
+		return nil, fmt.Errorf("bytes_used %d exceeds image size: %v", rd.sb.BytesUsed, err)
+	}
+	// Each fragment block occupies at least one byte of the data area
+	// between the superblock and the inode table.
+	if int64(rd.sb.Fragments) > rd.sb.InodeTableStart-96 {
+		return nil, fmt.Errorf("fragment count %d exceeds data area size %d", rd.sb.Fragments, rd.sb.InodeTableStart-96)
+	}
+
+	b, err := rd.readTable(rd.sb.IdTableStart, 4*int64(rd.sb.NoIds))
+	if err != nil {
+		return nil, fmt.Errorf("reading id table: %v", err)
+	}
+	rd.ids = make([]uint32, rd.sb.NoIds)
+	if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, rd.ids); err != nil {
+		return nil, fmt.Errorf("reading id table: %v", err)
+	}
+	b, err = rd.readTable(rd.sb.FragmentTableStart, 16*int64(rd.sb.Fragments))
+	if err != nil {
+		return nil, fmt.Errorf("reading fragment table: %v", err)
+	}
+	rd.fragments = make([]fragmentEntry, rd.sb.Fragments)
+	if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, rd.fragments); err != nil {
+		return nil, fmt.Errorf("reading fragment table: %v", err)
+	}
+	return rd, nil
+}
+
+// readTable returns the first size bytes of a table (e.g. the id table), which
+// is stored in consecutive metadata blocks referenced by a list of uint64
+// offsets starting at start. As size is derived from the superblock, the
+// returned buffer only grows as metadata blocks are actually read.
+func (r *Reader) readTable(start, size int64) ([]byte, error) {
+	if size == 0 {
+		return nil, nil
+	}
+	blocks := (size + metadataBlockSize - 1) / metadataBlockSize
+	if start < 96 || start > r.sb.BytesUsed-8*blocks {
+		return nil, fmt.Errorf("index of %d metadata blocks at %d exceeds bytes_used %d", blocks, start, r.sb.BytesUsed)
+	}
+	offsets := make([]int64, blocks)
+	if err := binary.Read(io.NewSectionReader(r.r, start, 8*blocks), binary.LittleEndian, offsets); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	for i, off := range offsets {
+		mb, err := r.metadataBlock(off)
+		if err != nil {
+			return nil, err
+		}
+		if i < len(offsets)-1 && offsets[i+1] != mb.next {
+			return nil, fmt.Errorf("metadata block %d at %d, want %d", i+1, offsets[i+1], mb.next)
+		}
+		buf.Write(mb.data)
+	}
+	if int64(buf.Len()) < size {
+		return nil, fmt.Errorf("table is %d bytes, want %d", buf.Len(), size)
+	}
+	return buf.Bytes()[:size], nil
+}
+
+// metadataBlock reads and decompresses the metadata block starting at the
+// absolute offset off.
+func (r *Reader) metadataBlock(off int64) (metadataBlock, error) {
+	r.mu.Lock()
+	mb, ok := r.metaBlocks[off]
+	r.mu.Unlock()
+	if ok {
+		return mb, nil
+	}
+	var hdr [2]byte
+	if _, err := r.r.ReadAt(hdr[:], off); err != nil {
+		return metadataBlock{}, fmt.Errorf("reading metadata block header at %d: %v", off, err)
+	}
+	length := binary.LittleEndian.Uint16(hdr[:])
+	compressed := length&0x8000 == 0
+	size := int64(length &^ 0x8000)
+	if size > metadataBlockSize {
+		return metadataBlock{}, fmt.Errorf("metadata block at %d: invalid size %d", off, size)
+	}
+	raw := make([]byte, size)
+	if _, err := r.r.ReadAt(raw, off+2); err != nil {
+		return metadataBlock{}, fmt.Errorf("reading metadata block at %d: %v", off, err)
+	}
+	if compressed {
+		var err error
+		raw, err = r.decompress(raw, metadataBlockSize)
+		if err != nil {
+			return metadataBlock{}, fmt.Errorf("metadata block at %d: %v", off, err)
+		}
+	}
+	mb = metadataBlock{
+		data: raw,
+		next: off + 2 + size,
+	}
+	r.mu.Lock()
+	r.metaBlocks[off] = mb
+	r.mu.Unlock()
+	return mb, nil
+}
+
+// decompress returns the decompressed contents of src, which must not exceed
+// limit bytes.
+func (r *Reader) decompress(src []byte, limit int) ([]byte, error) {
+	return decompress(r.sb.Compression, src, limit)
+}
+
+// metadataReader reads a stream of bytes which can span multiple metadata
+// blocks.
+type metadataReader struct {
+	r    *Reader
+	buf  []byte
+	next int64
+}
+
+// metadataReader returns a metadataReader positioned at offset within the
+// metadata block starting at block bytes after tableStart.
+func (r *Reader) metadataReader(tableStart int64, block uint32, offset uint16) (*metadataReader, error) {
+	mb, err := r.metadataBlock(tableStart + int64(block))
+	if err != nil {
+		return nil, err
+	}
+	if int(offset) > len(mb.data) {
+		return nil, fmt.Errorf("offset %d exceeds metadata block size %d", offset, len(mb.data))
+	}
+	return &metadataReader{
+		r:    r,
+		buf:  mb.data[offset:],
+		next: mb.next,
+	}, nil
+}
+
+// Read implements io.Reader
+func (mr *metadataReader) Read(p []byte) (n int, err error) {
+	for len(mr.buf) == 0 {
+		mb, err := mr.r.metadataBlock(mr.next)
+		if err != nil {
+			return 0, err
+		}
+		mr.buf = mb.data
+		mr.next = mb.next
+	}
+	n = copy(p, mr.buf)
+	mr.buf = mr.buf[n:]
+	return n, nil
+}
+
+// inodeInfo is the parsed representation of any inode type.
+type inodeInfo struct {
+	ref    inode
+	typ    uint16 // basic type, i.e. dirType for ldirType
+	mode   uint16
+	uid    uint32
+	gid    uint32
+	mtime  uint32
+	number uint32
+	nlink  uint32
+	size   int64
+
+	// regular files
+	startBlock int64
+	fragment   uint32
+	fragOffset uint32
+	blockSizes []uint32
+	sparse     int64 // bytes in holes, only stored in lreg inodes
+
+	// directories
+	dirBlock  uint32
+	dirOffset uint16
+	parent    uint32
+	index     []dirIndexEntry // only stored in ldir inodes
+
+	// symlinks
+	target string
+
+	// block and character devices
+	rdev uint32
+
+	// xattr is the xattr id table index, or invalidXattr.
+	xattr uint32
+}
+
+// basicType maps extended inode types to their basic counterparts.
+func basicType(typ uint16) uint16 {
+	if typ >= ldirType {
+		return typ - ldirType + dirType
+	}
+	return typ
+}
+
+func (r *Reader) id(idx uint16) (uint32, error) {
+	if int(idx) >= len(r.ids) {
+		return 0, fmt.Errorf("id index %d out of range [0, %d)", idx, len(r.ids))
+	}
+	return r.ids[idx], nil
+}
+
+// readInode reads the inode referenced by ref.
+func (r *Reader) readInode(ref inode) (*inodeInfo, error) {
+	mr, err := r.metadataReader(r.sb.InodeTableStart, uint32(ref>>16), uint16(ref&0xFFFF))
+	if err != nil {
+		return nil, err
+	}
+	var hdr inodeHeader
+	if err := binary.Read(mr, binary.LittleEndian, &hdr); err != nil {
+		return nil, err
+	}
+	ino := &inodeInfo{
+		ref:    ref,
+		typ:    basicType(hdr.InodeType),
+		mode:   hdr.Mode,
+		mtime:  hdr.Mtime,
+		number: hdr.InodeNumber,
+		nlink:  1,
+		xattr:  invalidXattr,
+	}
+	if ino.uid, err = r.id(hdr.Uid); err != nil {
+		return nil, err
+	}
+	if ino.gid, err = r.id(hdr.Gid); err != nil {
+		return nil, err
+	}
+
+	switch hdr.InodeType {
+	case dirType:
+		var dh struct {
+			StartBlock  uint32
+			Nlink       uint32
+			FileSize    uint16
+			Offset      uint16
+			ParentInode uint32
+		}
+		if err := binary.Read(mr, binary.LittleEndian, &dh); err != nil {
+			return nil, err
+		}
+		ino.dirBlock = dh.StartBlock
+		ino.nlink = dh.Nlink
+		ino.size = int64(dh.FileSize)
+		ino.dirOffset = dh.Offset
+		ino.parent = dh.ParentInode
+
+	case ldirType:
+		var dh struct {
+			Nlink       uint32
+			FileSize    uint32
+			StartBlock  uint32
+			ParentInode uint32
+			Icount      uint16
+			Offset      uint16
+			Xattr       uint32
+		}
+		if err := binary.Read(mr, binary.LittleEndian, &dh); err != nil {
+			return nil, err
+		}
+		ino.nlink = dh.Nlink
+		ino.size = int64(dh.FileSize)
+		ino.dirBlock = dh.StartBlock
+		ino.parent = dh.ParentInode
+		ino.dirOffset = dh.Offset
+		ino.xattr = dh.Xattr
+		for i := 0; i < int(dh.Icount); i++ {
+			var ie dirIndexEntry
+			if err := binary.Read(mr, binary.LittleEndian, &ie.dirIndex); err != nil {
+				return nil, err
+			}
+			if ie.Size >= 256 {
+				return nil, fmt.Errorf("directory index: invalid name size %d", ie.Size+1)
+			}
+			name := make([]byte, int(ie.Size)+1)
+			if _, err := io.ReadFull(mr, name); err != nil {
+				return nil, err
+			}
+			ie.name = string(name)
+			ino.index = append(ino.index, ie)
+		}
+
+	case fileType:
+		var fh struct {
+			StartBlock uint32
+			Fragment   uint32
+			Offset     uint32
+			FileSize   uint32
+		}
+		if err := binary.Read(mr, binary.LittleEndian, &fh); err != nil {
+			return nil, err
+		}
+		ino.startBlock = int64(fh.StartBlock)
+		ino.fragment = fh.Fragment
+		ino.fragOffset = fh.Offset
+		ino.size = int64(fh.FileSize)
+		if err := r.readBlockSizes(mr, ino); err != nil {
+			return nil, err
+		}
+
+	case lregType:
+		var fh struct {
+			StartBlock int64
+			FileSize   int64
+			Sparse     int64
+			Nlink      uint32
+			Fragment   uint32
+			Offset     uint32
+			Xattr      uint32
+		}
+		if err := binary.Read(mr, binary.LittleEndian, &fh); err != nil {
+			return nil, err
+		}
+		ino.startBlock = fh.StartBlock
+		ino.size = fh.FileSize
+		ino.sparse = fh.Sparse
+		ino.nlink = fh.Nlink
+		ino.fragment = fh.Fragment
+		ino.fragOffset = fh.Offset
+		ino.xattr = fh.Xattr
+		if err := r.readBlockSizes(mr, ino); err != nil {
+			return nil, err
+		}
+
+	case symlinkType, lsymlinkType:
+		var sh struct {
+			Nlink       uint32
+			SymlinkSize uint32
+		}
+		if err := binary.Read(mr, binary.LittleEndian, &sh); err != nil {
+			return nil, err
+		}
+		if sh.SymlinkSize > 4096 {
+			return nil, fmt.Errorf("symlink target too long (%d bytes)", sh.SymlinkSize)
+		}
+		target := make([]byte, sh.SymlinkSize)
+		if _, err := io.ReadFull(mr, target); err != nil {
+			return nil, err
+		}
+		ino.nlink = sh.Nlink
+		ino.target = string(target)
+		ino.size = int64(len(target))
+
+	case blkdevType, chrdevType, lblkdevType, lchrdevType:
+		var dh struct {
+			Nlink uint32
+			Rdev  uint32
+		}
+		if err := binary.Read(mr, binary.LittleEndian, &dh); err != nil {
+			return nil, err
+		}
+		ino.nlink = dh.Nlink
+		ino.rdev = dh.Rdev
+
+	case fifoType, socketType, lfifoType, lsocketType:
+		if err := binary.Read(mr, binary.LittleEndian, &ino.nlink); err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, fmt.Errorf("inode %d: unknown inode type %d", hdr.InodeNumber, hdr.InodeType)
+	}
+	switch hdr.InodeType {
+	case lsymlinkType, lblkdevType, lchrdevType, lfifoType, lsocketType:
+		// The extended variants are followed by an xattr index.
+		if err := binary.Read(mr, binary.LittleEndian, &ino.xattr); err != nil {
+			return nil, err
+		}
+	}
+	return ino, nil
+}
+
+// readBlockSizes reads the block size list which follows regular file inodes.
+func (r *Reader) readBlockSizes(mr *metadataReader, ino *inodeInfo) error {
+	if ino.size < 0 {
+		return fmt.Errorf("inode %d: invalid file size %d", ino.number, ino.size)
+	}
+	blockSize := int64(r.sb.BlockSize)
+	blocks := ino.size / blockSize
+	if ino.fragment == invalidFragment && ino.size%blockSize > 0 {
+		blocks++
+	}
+	if blocks > 1<<24 {
+		return fmt.Errorf("inode %d: too many blocks (%d)", ino.number, blocks)
+	}
+	ino.blockSizes = make([]uint32, blocks)
+	return binary.Read(mr, binary.LittleEndian, ino.blockSizes)
+}
+
+// rawDirEntry is a directory entry as stored in the directory table.
+type rawDirEntry struct {
+	name   string
+	typ    uint16
+	ref    inode
+	number uint32
+}
+
+// readDir reads all directory entries of the directory inode ino.
+func (r *Reader) readDir(ino *inodeInfo) ([]rawDirEntry, error) {
+	var entries []rawDirEntry
+	err := r.walkDir(ino, 0, ino.dirBlock, func(de rawDirEntry) bool {
+		entries = append(entries, de)
+		return true
+	})
+	return entries, err
+}
+
+// walkDir calls fn for the entries of the directory ino, starting with the
+// directory header at offset pos of the listing (0 for the first header),
+// which is stored in the metadata block block (see dirIndex). walkDir stops
+// once fn returns false.
+func (r *Reader) walkDir(ino *inodeInfo, pos int64, block uint32, fn func(rawDirEntry) bool) error {
+	// The size includes 3 bytes for the implicit . and .. entries.
+	remaining := ino.size - 3 - pos
+	if remaining <= 0 {
+		return nil
+	}
+	offset := uint16((int64(ino.dirOffset) + pos) % metadataBlockSize)
+	mr, err := r.metadataReader(r.sb.DirectoryTableStart, block, offset)
+	if err != nil {
+		return err
+	}
+	lr := &io.LimitedReader{R: mr, N: remaining}
+	for lr.N > 0 {
+		var dh dirHeader
+		if err := binary.Read(lr, binary.LittleEndian, &dh); err != nil {
+			return fmt.Errorf("reading directory header: %v", err)
+		}
+		if dh.Count >= maxDirHeaderEntries {
+			return fmt.Errorf("directory header: invalid count %d", dh.Count+1)
+		}
+		for i := uint32(0); i <= dh.Count; i++ {
+			var de dirEntry
+			if err := binary.Read(lr, binary.LittleEndian, &de); err != nil {
+				return fmt.Errorf("reading directory entry: %v", err)
+			}
+			name := make([]byte, int(de.Size)+1)
+			if _, err := io.ReadFull(lr, name); err != nil {
+				return fmt.Errorf("reading directory entry name: %v", err)
+			}
+			if !fn(rawDirEntry{
+				name:   string(name),
+				typ:    de.EntryType,
+				ref:    inode(int64(dh.StartBlock)<<16 | int64(de.Offset)),
+				number: uint32(int64(dh.InodeOffset) + int64(de.InodeNumber)),
+			}) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// lookupEntry returns the entry named name of the directory ino, or nil if
+// there is no such entry. Like the kernel, lookupEntry uses the directory
+// index (if any) to skip to the metadata block which contains the entry.
+func (r *Reader) lookupEntry(ino *inodeInfo, name string) (*rawDirEntry, error) {
+	var (
+		pos   int64
+		block = ino.dirBlock
+	)
+	for _, ie := range ino.index {
+		if ie.name > name {
+			break
+		}
+		pos, block = int64(ie.Index), ie.StartBlock
+	}
+	var found *rawDirEntry
+	err := r.walkDir(ino, pos, block, func(de rawDirEntry) bool {
+		if de.name == name {
+			found = &de
+		}
+		// Entries are sorted by name.
+		return de.name < name
+	})
+	return found, err
+}
+
+// maxSymlinks is the maximum number of symbolic links that are followed when
+// resolving a path.
+const maxSymlinks = 40
+
+// lookup resolves name (a path as accepted by fs.ValidPath) to an inode. If
+// follow is true, a symbolic link in the last path element is followed.
+func (r *Reader) lookup(op, name string, follow bool) (*inodeInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	ino, err := r.readInode(r.sb.RootInode)
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	var (
+		dirPath    string   // path of the directory containing the current element
+		components []string // remaining path elements
+		symlinks   int
+	)
+	if name != "." {
+		components = strings.Split(name, "/")
+	}
+	for len(components) > 0 {
+		elem := components[0]
+		components = components[1:]
+		if ino.typ != dirType {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		found, err := r.lookupEntry(ino, elem)
+		if err != nil {
+			return nil, &fs.PathError{Op: op, Path: name, Err: err}
+		}
+		if found == nil {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		ino, err = r.readInode(found.ref)
+		if err != nil {
+			return nil, &fs.PathError{Op: op, Path: name, Err: err}
+		}
+		if ino.typ == symlinkType && (len(components) > 0 || follow) {
+			symlinks++
+			if symlinks > maxSymlinks {
+				return nil, &fs.PathError{Op: op, Path: name, Err: errors.New("too many levels of symbolic links")}
+			}
+			target := ino.target
+			if !strings.HasPrefix(target, "/") {
+				target = path.Join("/", dirPath, target)
+			}
+			// Restart resolution from the root, interpreting absolute
+			// targets relative to the root of the image. path.Clean removes
+			// any .. elements which would leave the root.
+			resolved := strings.Split(strings.Trim(path.Clean(target), "/"), "/")
+			if len(resolved) == 1 && resolved[0] == "" {
+				resolved = nil
+			}
+			components = append(resolved, components...)
+			if ino, err = r.readInode(r.sb.RootInode); err != nil {
+				return nil, &fs.PathError{Op: op, Path: name, Err: err}
+			}
+			dirPath = ""
+			continue
+		}
+		dirPath = path.Join(dirPath, elem)
+	}
+	return ino, nil
+}
+
+// fileMode converts the SquashFS mode and inode type to an fs.FileMode.
+func fileMode(typ, mode uint16) fs.FileMode {
+	m := fs.FileMode(mode & 0o777)
+	if mode&0o4000 != 0 {
+		m |= fs.ModeSetuid
+	}
+	if mode&0o2000 != 0 {
+		m |= fs.ModeSetgid
+	}
+	if mode&0o1000 != 0 {
+		m |= fs.ModeSticky
+	}
+	switch typ {
+	case dirType:
+		m |= fs.ModeDir
+	case symlinkType:
+		m |= fs.ModeSymlink
+	case blkdevType:
+		m |= fs.ModeDevice
+	case chrdevType:
+		m |= fs.ModeDevice | fs.ModeCharDevice
+	case fifoType:
+		m |= fs.ModeNamedPipe
+	case socketType:
+		m |= fs.ModeSocket
+	}
+	return m
+}
+
+// Stat contains SquashFS-specific metadata of a file. The Sys method of
+// fs.FileInfo values returned by Reader returns a *Stat.
+type Stat struct {
+	Inode uint32 // inode number
+	Nlink uint32
+	Uid   uint32
+	Gid   uint32
+	Rdev  uint32 // device number (block and character devices only)
+}
+
+// Major returns the major device number of a block or character device.
+func (s *Stat) Major() uint32 {
+	major, _ := decodeDev(s.Rdev)
+	return major
+}
+
+// Minor returns the minor device number of a block or character device.
+func (s *Stat) Minor() uint32 {
+	_, minor := decodeDev(s.Rdev)
+	return minor
+}
+
+type fileInfo struct {
+	name string
+	ino  *inodeInfo
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.ino.size }
+func (fi *fileInfo) Mode() fs.FileMode  { return fileMode(fi.ino.typ, fi.ino.mode) }
+func (fi *fileInfo) ModTime() time.Time { return time.Unix(int64(fi.ino.mtime), 0) }
+func (fi *fileInfo) IsDir() bool        { return fi.ino.typ == dirType }
+func (fi *fileInfo) Sys() any {
+	return &Stat{
+		Inode: fi.ino.number,
+		Nlink: fi.ino.nlink,
+		Uid:   fi.ino.uid,
+		Gid:   fi.ino.gid,
+		Rdev:  fi.ino.rdev,
+	}
+}
+
+type dirEntryInfo struct {
+	r  *Reader
+	de rawDirEntry
+}
+
+func (de *dirEntryInfo) Name() string      { return de.de.name }
+func (de *dirEntryInfo) IsDir() bool       { return de.de.typ == dirType }
+func (de *dirEntryInfo) Type() fs.FileMode { return fileMode(de.de.typ, 0).Type() }
+func (de *dirEntryInfo) Info() (fs.FileInfo, error) {
+	ino, err := de.r.readInode(de.de.ref)
+	if err != nil {
+		return nil, err
+	}
+	return &fileInfo{name: de.de.name, ino: ino}, nil
+}
+func (de *dirEntryInfo) String() string { return fs.FormatDirEntry(de) }
+
+// baseName returns the name of the file at path name, as returned by
+// fs.FileInfo.Name.
+func baseName(name string) string {
+	if name == "." {
+		return "."
+	}
+	return path.Base(name)
+}
+
+// Open implements fs.FS. Symbolic links are followed.
+func (r *Reader) Open(name string) (fs.File, error) {
+	ino, err := r.lookup("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	fi := &fileInfo{name: baseName(name), ino: ino}
+	if ino.typ == dirType {
+		entries, err := r.readDir(ino)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		return &openDir{r: r, fi: fi, entries: entries}, nil
+	}
+	return &openFile{r: r, fi: fi, path: name}, nil
+}
+
+// ReadDir implements fs.ReadDirFS.
+func (r *Reader) ReadDir(name string) ([]fs.DirEntry, error) {
+	ino, err := r.lookup("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if ino.typ != dirType {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	entries, err := r.readDir(ino)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	result := make([]fs.DirEntry, len(entries))
+	for idx, de := range entries {
+		result[idx] = &dirEntryInfo{r: r, de: de}
+	}
+	return result, nil
+}
+
+// Stat implements fs.StatFS. Symbolic links are followed.
+func (r *Reader) Stat(name string) (fs.FileInfo, error) {
+	ino, err := r.lookup("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return &fileInfo{name: baseName(name), ino: ino}, nil
+}
+
+// Lstat is like Stat, but does not follow a symbolic link in the last path
+// element.
+func (r *Reader) Lstat(name string) (fs.FileInfo, error) {
+	ino, err := r.lookup("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return &fileInfo{name: baseName(name), ino: ino}, nil
+}
+
+// ReadLink returns the target of the symbolic link name.
+func (r *Reader) ReadLink(name string) (string, error) {
+	ino, err := r.lookup("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if ino.typ != symlinkType {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return ino.target, nil
+}
+
+// openDir is a directory opened via Reader.Open.
+type openDir struct {
+	r       *Reader
+	fi      *fileInfo
+	entries []rawDirEntry
+	pos     int
+}
+
+func (d *openDir) Stat() (fs.FileInfo, error) { return d.fi, nil }
+func (d *openDir) Close() error               { return nil }
+func (d *openDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.fi.name, Err: errors.New("is a directory")}
+}
+
+// ReadDir implements fs.ReadDirFile.
+func (d *openDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	remaining := d.entries[d.pos:]
+	if n > 0 && len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	if n > 0 && n < len(remaining) {
+		remaining = remaining[:n]
+	}
+	result := make([]fs.DirEntry, len(remaining))
+	for idx, de := range remaining {
+		result[idx] = &dirEntryInfo{r: d.r, de: de}
+	}
+	d.pos += len(remaining)
+	return result, nil
+}
+
+// openFile is a non-directory file opened via Reader.Open. Only regular files
+// have contents, reading other file types results in io.EOF.
+type openFile struct {
+	r    *Reader
+	fi   *fileInfo
+	path string
+	off  int64
+
+	// blockOffsets contains the absolute offset of each data block.
+	blockOffsets []int64
+
+	// mu guards blockOffsets and the block cache, so that ReadAt can be
+	// called concurrently as io.ReaderAt requires.
+	mu sync.Mutex
+	// cached holds the decompressed contents of block cachedIdx.
+	cachedIdx int
+	cached    []byte
+}
+
+func (f *openFile) Stat() (fs.FileInfo, error) { return f.fi, nil }
+func (f *openFile) Close() error               { return nil }
+
+// Read implements io.Reader.
+func (f *openFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.off)
+	f.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek implements io.Seeker.
+func (f *openFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += f.fi.ino.size
+	default:
+		return 0, &fs.PathError{Op: "seek", Path: f.path, Err: fs.ErrInvalid}
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.path, Err: fs.ErrInvalid}
+	}
+	f.off = offset
+	return offset, nil
+}
+
+// ReadAt implements io.ReaderAt.
+func (f *openFile) ReadAt(p []byte, off int64) (int, error) {
+	ino := f.fi.ino
+	if ino.typ != fileType {
+		return 0, io.EOF
+	}
+	if off < 0 {
+		return 0, &fs.PathError{Op: "read", Path: f.path, Err: fs.ErrInvalid}
+	}
+	var n int
+	for n < len(p) && off < ino.size {
+		idx := int(off / int64(f.r.sb.BlockSize))
+		b, err := f.cachedBlock(idx)
+		if err != nil {
+			return n, &fs.PathError{Op: "read", Path: f.path, Err: err}
+		}
+		blockOff := int(off % int64(f.r.sb.BlockSize))
+		if blockOff >= len(b) {
+			return n, &fs.PathError{Op: "read", Path: f.path, Err: io.ErrUnexpectedEOF}
+		}
+		c := copy(p[n:], b[blockOff:])
+		n += c
+		off += int64(c)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// cachedBlock returns block(idx), re-using the most recently read block.
+func (f *openFile) cachedBlock(idx int) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.cached == nil || f.cachedIdx != idx {
+		b, err := f.block(idx)
+		if err != nil {
+			return nil, err
+		}
+		f.cached = b
+		f.cachedIdx = idx
+	}
+	return f.cached, nil
+}
+
+// block returns the decompressed contents of data block idx, or of the
+// fragment if idx refers to the file's tail end. The caller must hold f.mu.
+func (f *openFile) block(idx int) ([]byte, error) {
+	ino := f.fi.ino
+	blockSize := int64(f.r.sb.BlockSize)
+	expected := blockSize
+	if rest := ino.size - int64(idx)*blockSize; rest < expected {
+		expected = rest
+	}
+	if idx >= len(ino.blockSizes) {
+		b, err := f.r.fragment(ino.fragment)
+		if err != nil {
+			return nil, err
+		}
+		end := int64(ino.fragOffset) + expected
+		if end > int64(len(b)) {
+			return nil, fmt.Errorf("fragment %d: offset %d exceeds fragment size %d", ino.fragment, end, len(b))
+		}
+		return b[ino.fragOffset:end], nil
+	}
+	if f.blockOffsets == nil {
+		f.blockOffsets = make([]int64, len(ino.blockSizes))
+		off := ino.startBlock
+		for i, size := range ino.blockSizes {
+			f.blockOffsets[i] = off
+			off += int64(size &^ (1 << 24))
+		}
+	}
+	size := ino.blockSizes[idx]
+	if size == 0 {
+		// sparse block
+		return make([]byte, expected), nil
+	}
+	b, err := f.r.dataBlock(f.blockOffsets[idx], size)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) < expected {
+		return nil, fmt.Errorf("block %d: got %d bytes, want %d", idx, len(b), expected)
+	}
+	return b, nil
+}
+
+// dataBlock reads and (if necessary) decompresses the data block at the
+// absolute offset off, whose on-disk size (including the uncompressed bit) is
+// size.
+func (r *Reader) dataBlock(off int64, size uint32) ([]byte, error) {
+	uncompressed := size&(1<<24) != 0
+	size &^= 1 << 24
+	if size > r.sb.BlockSize {
+		return nil, fmt.Errorf("data block at %d: invalid size %d", off, size)
+	}
+	b := make([]byte, size)
+	if _, err := r.r.ReadAt(b, off); err != nil {
+		return nil, fmt.Errorf("reading data block at %d: %v", off, err)
+	}
+	if uncompressed {
+		return b, nil
+	}
+	return r.decompress(b, int(r.sb.BlockSize))
+}
+
+// fragment returns the decompressed contents of fragment block idx. The
+// returned slice must not be modified.
+func (r *Reader) fragment(idx uint32) ([]byte, error) {
+	if int64(idx) >= int64(len(r.fragments)) {
+		return nil, fmt.Errorf("fragment index %d out of range [0, %d)", idx, len(r.fragments))
+	}
+	r.mu.Lock()
+	b := r.lastFragment
+	cached := b != nil && r.lastFragmentIdx == idx
+	r.mu.Unlock()
+	if cached {
+		return b, nil
+	}
+	fe := r.fragments[idx]
+	b, err := r.dataBlock(fe.Start, fe.Size)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	r.lastFragmentIdx = idx
+	r.lastFragment = b
+	r.mu.Unlock()
+	return b, nil
+}
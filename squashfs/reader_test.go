@@ -0,0 +1,250 @@
+package squashfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// writeTestImage creates a SquashFS image in a temporary file, calling fill to
+// populate the Root directory. The Writer (and thereby all directories) is
+// flushed by writeTestImage, and the resulting image is verified using Check.
+func writeTestImage(t *testing.T, fill func(w *Writer), opts ...Option) *os.File {
+	t.Helper()
+	f, err := os.Create(filepath.Join(t.TempDir(), "squashfs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	w, err := NewWriter(f, time.Now(), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fill(w)
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := Check(f); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func writeTestFile(t *testing.T, d *Directory, name string, mode os.FileMode, contents []byte) {
+	t.Helper()
+	ff, err := d.File(name, time.Unix(1234567890, 0), mode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ff.Write(contents); err != nil {
+		t.Fatal(err)
+	}
+	if err := ff.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func addTestDirectory(t *testing.T, d *Directory, name string, modTime time.Time, mode os.FileMode, opts ...EntryOption) *Directory {
+	t.Helper()
+	sub, err := d.Directory(name, modTime, mode, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sub
+}
+
+func TestReader(t *testing.T) {
+	t.Parallel()
+
+	// larger than one block, compresses well
+	large := bytes.Repeat([]byte("gokrazy "), 3*dataBlockSize/8+17)
+	// larger than one block, does not compress
+	random := make([]byte, dataBlockSize+4096)
+	for i := range random {
+		random[i] = byte(i*7919 + i>>8)
+	}
+
+	f := writeTestImage(t, func(w *Writer) {
+		writeTestFile(t, w.Root, "hellö wörld", 0o444, []byte("hello world!"))
+		writeTestFile(t, w.Root, "large", 0o444, large)
+		writeTestFile(t, w.Root, "leer", 0o444, nil)
+		writeTestFile(t, w.Root, "random", 0o644, random)
+		if err := w.Root.Symlink("subdir/deep/yo", "shortcut", time.Now(), 0o777); err != nil {
+			t.Fatal(err)
+		}
+		subdir := addTestDirectory(t, w.Root, "subdir", time.Now(), 0o755)
+		deep := addTestDirectory(t, subdir, "deep", time.Now(), 0o755)
+		writeTestFile(t, deep, "yo", 0o555, []byte("foo\n"))
+		if err := deep.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if err := subdir.Symlink("../large", "up", time.Now(), 0o777); err != nil {
+			t.Fatal(err)
+		}
+		if err := subdir.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	r, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fstest.TestFS(r,
+		"hellö wörld",
+		"large",
+		"leer",
+		"random",
+		"shortcut",
+		"subdir/deep/yo",
+		"subdir/up"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, entry := range []struct {
+		path string
+		want []byte
+	}{
+		{"hellö wörld", []byte("hello world!")},
+		{"large", large},
+		{"leer", nil},
+		{"random", random},
+		{"shortcut", []byte("foo\n")},
+		{"subdir/deep/yo", []byte("foo\n")},
+		{"subdir/up", large},
+	} {
+		got, err := fs.ReadFile(r, entry.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, entry.want) {
+			t.Errorf("path %q differs: got %d bytes, want %d bytes", entry.path, len(got), len(entry.want))
+		}
+	}
+
+	fi, err := r.Stat("subdir/deep/yo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fi.Mode(), fs.FileMode(0o555); got != want {
+		t.Errorf("Stat(subdir/deep/yo).Mode() = %v, want %v", got, want)
+	}
+	if got, want := fi.ModTime(), time.Unix(1234567890, 0); !got.Equal(want) {
+		t.Errorf("Stat(subdir/deep/yo).ModTime() = %v, want %v", got, want)
+	}
+
+	fi, err = r.Lstat("shortcut")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fi.Mode().Type(), fs.ModeSymlink; got != want {
+		t.Errorf("Lstat(shortcut).Mode().Type() = %v, want %v", got, want)
+	}
+	target, err := r.ReadLink("subdir/up")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := target, "../large"; got != want {
+		t.Errorf("ReadLink(subdir/up) = %q, want %q", got, want)
+	}
+	if _, err := r.ReadLink("large"); !errors.Is(err, fs.ErrInvalid) {
+		t.Errorf("ReadLink(large) = %v, want %v", err, fs.ErrInvalid)
+	}
+
+	if _, err := r.Open("subdir/nonexistent"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Open(subdir/nonexistent) = %v, want %v", err, fs.ErrNotExist)
+	}
+
+	entries, err := r.ReadDir("subdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if got, want := strings.Join(names, ","), "deep,up"; got != want {
+		t.Errorf("ReadDir(subdir) = %q, want %q", got, want)
+	}
+
+	// Verify random access via io.ReaderAt across block boundaries.
+	rf, err := r.Open("random")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+	buf := make([]byte, 8192)
+	if _, err := rf.(io.ReaderAt).ReadAt(buf, dataBlockSize-4096); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, random[dataBlockSize-4096:dataBlockSize+4096]) {
+		t.Errorf("ReadAt across block boundary returned unexpected data")
+	}
+}
+
+func TestReaderConcurrentReadAt(t *testing.T) {
+	t.Parallel()
+
+	contents := make([]byte, 4*dataBlockSize+4096)
+	for i := range contents {
+		contents[i] = byte(i*7919 + i>>8)
+	}
+	f := writeTestImage(t, func(w *Writer) {
+		writeTestFile(t, w.Root, "file", 0o644, contents)
+	})
+	r, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rf, err := r.Open("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ra := rf.(io.ReaderAt)
+
+	// Each goroutine reads from a different block, so that the block cache is
+	// replaced constantly (run with -race to detect unsynchronized access).
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for g := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 4096)
+			for i := range 50 {
+				off := int64(g*dataBlockSize + i*1000)
+				if _, err := ra.ReadAt(buf, off); err != nil {
+					errs <- err
+					return
+				}
+				if !bytes.Equal(buf, contents[off:off+int64(len(buf))]) {
+					errs <- fmt.Errorf("ReadAt(%d) returned unexpected data", off)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestReaderInvalid(t *testing.T) {
+	t.Parallel()
+
+	if _, err := NewReader(bytes.NewReader(make([]byte, 4096))); err == nil {
+		t.Fatal("NewReader unexpectedly succeeded on an all-zero image")
+	}
+}
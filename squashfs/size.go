@@ -0,0 +1,169 @@
+package squashfs
+
+import "fmt"
+
+// SizeError is returned by Writer methods once the image (data plus estimated
+// metadata) exceeds the maximum size set using WithMaxSize.
+type SizeError struct {
+	// MaxSize is the maximum image size in bytes.
+	MaxSize int64
+
+	// Size is the estimated image size in bytes or, when returned by
+	// Writer.Flush, the actual image size.
+	Size int64
+
+	// Path is the file system entry which was being added when the maximum
+	// size was exceeded, or "" if the error was returned by Writer.Flush.
+	Path string
+}
+
+func (e *SizeError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("squashfs: image size %d bytes exceeds maximum of %d bytes", e.Size, e.MaxSize)
+	}
+	return fmt.Sprintf("squashfs: %s: image size estimate %d bytes exceeds maximum of %d bytes", e.Path, e.Size, e.MaxSize)
+}
+
+// WithMaxSize sets the maximum image size in bytes (including the padding to
+// a multiple of 4096 bytes), e.g. the size of the partition which the image
+// is written to. Once SizeEstimate exceeds n, Writer methods (including the
+// Write and Close methods of files) return a *SizeError. As the blocks of a
+// file are discarded when Close finds that its contents are a duplicate, Write
+// only checks the size once the file is larger than all files written before.
+func WithMaxSize(n int64) Option {
+	return func(w *Writer) {
+		w.maxSize = n
+	}
+}
+
+// Estimated on-disk sizes of metadata, assuming uncompressed metadata (see
+// WithMetadataCompression) and extended inodes (see Writer.SizeEstimate).
+const (
+	dirEntrySizeEstimate   = dirEntrySize + dirHeaderSize // assuming a header per entry
+	ldirInodeSizeEstimate  = 40                           // ldirInodeHeader
+	lregInodeSizeEstimate  = 56                           // lregInodeHeader (without block sizes)
+	symlinkSizeEstimate    = 24 + 4                       // symlinkInodeHeader (without target), xattr index
+	devInodeSizeEstimate   = 24 + 4                       // devInodeHeader, xattr index
+	ipcInodeSizeEstimate   = 20 + 4                       // ipcInodeHeader, xattr index
+	idEntrySize            = 4                            // id table entry
+	fragmentEntrySize      = 16                           // fragmentEntry
+	metadataBlockOverhead  = 2 + 8                        // block header, table index entry
+	xattrIdEntrySize       = 16                           // xattrId
+	superblockSizeEstimate = 96 + 16                      // superblock, xattr id table header
+)
+
+// estimateEntry adds the directory entry named name (whose inode, if not
+// already accounted for, takes inodeSize bytes) to the metadata estimate.
+func (w *Writer) estimateEntry(name string, inodeSize int) {
+	w.metadataEstimate += int64(dirEntrySizeEstimate + len(name) + inodeSize)
+}
+
+// SizeEstimate returns the estimated size in bytes of the image written so far,
+// i.e. if Flush was called now: the data written to the underlying writer
+// (blocks of files which are still being written are included once they were
+// compressed), the uncompressed size of the current fragment block, and the
+// size of all metadata, estimated generously: metadata compression is not
+// taken into account, and the largest inode type is assumed.
+//
+// After Flush, SizeEstimate returns the actual size of the image.
+func (w *Writer) SizeEstimate() int64 {
+	if w.imageSize > 0 {
+		return w.imageSize
+	}
+	fragments := len(w.fragments)
+	if w.fragBuf.Len() > 0 {
+		fragments++
+	}
+	metadata := w.metadataEstimate +
+		w.xattrBuf.size +
+		int64(len(w.xattrIds)*xattrIdEntrySize) +
+		int64(fragments*fragmentEntrySize) +
+		int64(max(len(w.ids), 1)*idEntrySize)
+	// Each table consists of at least one metadata block.
+	blocks := metadataBlocks(metadata) + 5
+	size := w.dataEnd +
+		int64(w.fragBuf.Len()) +
+		metadata +
+		blocks*metadataBlockOverhead +
+		superblockSizeEstimate
+	return (size + 4095) &^ 4095
+}
+
+// metadataBlocks returns the number of metadata blocks for size bytes.
+func metadataBlocks(size int64) int64 {
+	return (size + metadataBlockSize - 1) / metadataBlockSize
+}
+
+// checkSize returns a *SizeError if the image exceeds the maximum size (if
+// any) while adding the entry at path p.
+func (w *Writer) checkSize(p string) error {
+	if w.maxSize <= 0 {
+		return nil
+	}
+	if size := w.SizeEstimate(); size > w.maxSize {
+		return &SizeError{
+			MaxSize: w.maxSize,
+			Size:    size,
+			Path:    p,
+		}
+	}
+	return nil
+}
+
+// FileStat describes how the contents of a regular file are stored, see
+// Writer.FileStats.
+type FileStat struct {
+	// Path is the path of the file within the image, e.g. "/usr/bin/x".
+	Path string
+
+	// InputBytes is the size of the file contents.
+	InputBytes int64
+
+	// StoredBytes is the number of bytes the file contents occupy in the
+	// image: the size of all (possibly compressed) data blocks, plus the share
+	// of the fragment block containing the end of the file, which is
+	// proportional to the size of the end of the file. Inodes and directory
+	// entries are not included.
+	StoredBytes int64
+
+	// Duplicate is true if the file has the same contents as a previously
+	// written file (or a file of the previous image, see WithPreviousImage),
+	// whose data is referenced instead (StoredBytes is 0).
+	Duplicate bool
+}
+
+// Ratio returns the compression ratio, i.e. StoredBytes divided by InputBytes
+// (e.g. 0.25 if the file contents were compressed to a quarter of their size),
+// or 1 for empty files.
+func (s FileStat) Ratio() float64 {
+	if s.InputBytes == 0 {
+		return 1
+	}
+	return float64(s.StoredBytes) / float64(s.InputBytes)
+}
+
+// fragmentTail is the end of a file which is stored in the current fragment
+// block.
+type fragmentTail struct {
+	stat int // index into Writer.fileStats
+	size int
+}
+
+// FileStats returns statistics for all regular files written so far, in the
+// order in which they were closed, e.g. to determine which files contribute
+// most to the image size. The share of the current fragment block is only
+// included once the fragment block was written (at the latest by Flush).
+func (w *Writer) FileStats() []FileStat {
+	return append([]FileStat(nil), w.fileStats...)
+}
+
+// accountFragment apportions the on-disk size of the fragment block which was
+// just written to the files whose ends it contains.
+func (w *Writer) accountFragment(size uint32) {
+	stored := int64(size &^ (1 << 24))
+	total := int64(w.fragBuf.Len())
+	for _, tail := range w.fragmentTails {
+		w.fileStats[tail.stat].StoredBytes += stored * int64(tail.size) / total
+	}
+	w.fragmentTails = w.fragmentTails[:0]
+}
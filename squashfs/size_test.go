@@ -0,0 +1,164 @@
+package squashfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSizeEstimate(t *testing.T) {
+	t.Parallel()
+
+	random := make([]byte, dataBlockSize+4321)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	for _, opts := range [][]Option{
+		nil,
+		{WithMetadataCompression()},
+	} {
+		var (
+			w        *Writer
+			estimate int64
+		)
+		f := writeTestImage(t, func(wr *Writer) {
+			w = wr
+			for i := 0; i < 300; i++ {
+				random[0] = byte(i)
+				random[1] = byte(i >> 8)
+				writeTestFile(t, w.Root, fmt.Sprintf("file%03d", i), 0o644, random[:len(random)-i])
+				if i%3 == 0 {
+					// duplicate contents
+					writeTestFile(t, w.Root, fmt.Sprintf("dup%03d", i), 0o644, random[:len(random)-i])
+				}
+				if err := w.AddSymlink("target", fmt.Sprintf("/dir%02d/link%03d", i%10, i), time.Now(), 0o777); err != nil {
+					t.Fatal(err)
+				}
+			}
+			estimate = w.SizeEstimate()
+		}, opts...)
+		st, err := f.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if estimate < st.Size() {
+			t.Errorf("SizeEstimate() before Flush = %d, want at least the actual size %d", estimate, st.Size())
+		}
+		// writeTestImage calls Flush, after which the actual size is returned.
+		if got, want := w.SizeEstimate(), st.Size(); got != want {
+			t.Errorf("SizeEstimate() after Flush = %d, want %d", got, want)
+		}
+	}
+}
+
+func TestMaxSize(t *testing.T) {
+	t.Parallel()
+
+	random := make([]byte, 4*dataBlockSize)
+	rand.New(rand.NewSource(3)).Read(random)
+
+	const maxSize = 2 * dataBlockSize
+	f, err := os.Create(filepath.Join(t.TempDir(), "squashfs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w, err := NewWriter(f, time.Now(), WithMaxSize(maxSize), WithParallelism(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ff, err := w.AddFile("/usr/share/bloat", time.Now(), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The size is checked while streaming the file contents, i.e. Write fails
+	// long before all of the (unbounded) contents were written.
+	var written int
+	for written < 64*dataBlockSize {
+		if _, err = ff.Write(random); err != nil {
+			break
+		}
+		written += len(random)
+	}
+	var serr *SizeError
+	if !errors.As(err, &serr) {
+		t.Fatalf("writing %d bytes of random data: got error %v, want a *SizeError", written, err)
+	}
+	if written > 2*len(random) {
+		t.Errorf("Write returned a *SizeError only after %d bytes, want at most %d", written, 2*len(random))
+	}
+	if got, want := serr.Path, "/usr/share/bloat"; got != want {
+		t.Errorf("SizeError.Path = %q, want %q", got, want)
+	}
+	if serr.MaxSize != maxSize || serr.Size <= maxSize {
+		t.Errorf("SizeError = %+v, want MaxSize %d and a larger Size", serr, maxSize)
+	}
+
+	// Images within the maximum size are not affected.
+	writeTestImage(t, func(w *Writer) {
+		writeTestFile(t, w.Root, "small", 0o644, random[:dataBlockSize/2])
+	}, WithMaxSize(maxSize))
+
+	// Duplicate contents do not count towards the maximum size, even though
+	// their blocks are written until Close detects the duplicate.
+	writeTestImage(t, func(w *Writer) {
+		contents := random[:3*dataBlockSize/2]
+		writeTestFile(t, w.Root, "original", 0o644, contents)
+		writeTestFile(t, w.Root, "duplicate", 0o644, contents)
+	}, WithMaxSize(maxSize), WithParallelism(1))
+
+	// The same applies to duplicates of files in the previous image.
+	contents := random[:3*dataBlockSize]
+	prev := readTestImage(t, writeTestImage(t, func(w *Writer) {
+		writeTestFile(t, w.Root, "original", 0o644, contents)
+	}))
+	writeTestImage(t, func(w *Writer) {
+		writeTestFile(t, w.Root, "duplicate", 0o644, contents)
+	}, WithPreviousImage(bytes.NewReader(prev), 0.5), WithMaxSize(int64(len(prev))+dataBlockSize), WithParallelism(1))
+}
+
+func TestFileStats(t *testing.T) {
+	t.Parallel()
+
+	random := make([]byte, 2*dataBlockSize+100)
+	rand.New(rand.NewSource(4)).Read(random)
+	compressible := bytes.Repeat([]byte("gokrazy "), dataBlockSize/4)
+
+	var w *Writer
+	writeTestImage(t, func(wr *Writer) {
+		w = wr
+		writeTestFile(t, w.Root, "compressible", 0o644, compressible)
+		writeTestFile(t, w.Root, "random", 0o644, random)
+		writeTestFile(t, w.Root, "duplicate", 0o644, random)
+		writeTestFile(t, w.Root, "empty", 0o644, nil)
+		writeTestFile(t, w.Root, "sparse", 0o644, make([]byte, dataBlockSize))
+	})
+	stats := w.FileStats()
+	if got, want := len(stats), 5; got != want {
+		t.Fatalf("len(FileStats()) = %d, want %d", got, want)
+	}
+	byPath := make(map[string]FileStat)
+	for _, s := range stats {
+		byPath[s.Path] = s
+	}
+
+	if s := byPath["/compressible"]; s.InputBytes != int64(len(compressible)) || s.Ratio() > 0.1 {
+		t.Errorf("compressible: %+v (ratio %.2f), want %d input bytes, ratio <= 0.1", s, s.Ratio(), len(compressible))
+	}
+	if s := byPath["/random"]; s.InputBytes != int64(len(random)) || s.Ratio() < 1 || s.StoredBytes > s.InputBytes {
+		t.Errorf("random: %+v (ratio %.2f), want %d input bytes, stored uncompressed", s, s.Ratio(), len(random))
+	}
+	if s := byPath["/duplicate"]; !s.Duplicate || s.StoredBytes != 0 {
+		t.Errorf("duplicate: %+v, want Duplicate with 0 stored bytes", s)
+	}
+	if s := byPath["/empty"]; s.StoredBytes != 0 || s.Ratio() != 1 {
+		t.Errorf("empty: %+v (ratio %.2f), want 0 stored bytes, ratio 1", s, s.Ratio())
+	}
+	if s := byPath["/sparse"]; s.StoredBytes != 0 || s.Ratio() != 0 {
+		t.Errorf("sparse: %+v (ratio %.2f), want 0 stored bytes, ratio 0", s, s.Ratio())
+	}
+}
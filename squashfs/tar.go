@@ -0,0 +1,176 @@
+package squashfs
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"strings"
+)
+
+// paxXattrPrefix is the prefix of PAX records which store extended
+// attributes, as written by GNU tar and bsdtar.
+const paxXattrPrefix = "SCHILY.xattr."
+
+// WriteTar adds all entries of the tar archive read from r to dir, creating
+// missing parent directories. Regular files, directories, symbolic links, hard
+// links, device nodes and named pipes are supported, keeping their mode,
+// modification time, ownership and extended attributes. Other entry types
+// (and entries whose path leaves dir) result in an error.
+//
+// A hard link must refer to an entry which precedes it in the archive, as is
+// always the case for archives created by tar(1). The "." entry sets the
+// attributes of dir if dir was created implicitly (e.g. Root).
+func WriteTar(dir *Directory, r io.Reader, opts ...TarOption) error {
+	var o tarOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	var flusher *walkFlusher
+	if o.flushDirectories {
+		flusher = &walkFlusher{w: dir.w}
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			if flusher != nil {
+				return flusher.visit("")
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue // no file system entry
+		}
+		if err := dir.addTarEntry(hdr, tr, flusher); err != nil {
+			return fmt.Errorf("%s: %w", hdr.Name, err)
+		}
+	}
+}
+
+// A TarOption configures optional WriteTar behavior.
+type TarOption func(*tarOptions)
+
+type tarOptions struct {
+	flushDirectories bool
+}
+
+// WithTarFlush makes WriteTar flush each directory of the archive once the
+// archive continues with an entry outside of it, so that the metadata of large
+// archives does not remain in memory (see WithMetadataSpill). This requires
+// that the contents of each directory are stored consecutively, and that hard
+// links only refer to entries of directories which the archive did not leave
+// yet: tar(1) creates such archives for trees without hard links between
+// directories. Otherwise, WriteTar fails, as entries cannot be added to
+// flushed directories.
+func WithTarFlush() TarOption {
+	return func(o *tarOptions) {
+		o.flushDirectories = true
+	}
+}
+
+// cleanTarPath returns the slash-separated path of a tar entry relative to the
+// archive root, or "" for the root itself.
+func cleanTarPath(name string) (string, error) {
+	p := path.Clean(strings.TrimLeft(name, "/"))
+	if p == ".." || strings.HasPrefix(p, "../") {
+		return "", fmt.Errorf("squashfs: path leaves the archive root")
+	}
+	if p == "." {
+		return "", nil
+	}
+	return p, nil
+}
+
+// addTarEntry adds the entry described by hdr, whose contents are read from r.
+// If flusher is non-nil, directories which the archive left are flushed.
+func (d *Directory) addTarEntry(hdr *tar.Header, r io.Reader, flusher *walkFlusher) error {
+	name, err := cleanTarPath(hdr.Name)
+	if err != nil {
+		return err
+	}
+	if flusher != nil && name != "" {
+		if err := flusher.visit(name); err != nil {
+			return err
+		}
+	}
+	if hdr.Uid < 0 || int64(hdr.Uid) > math.MaxUint32 || hdr.Gid < 0 || int64(hdr.Gid) > math.MaxUint32 {
+		return fmt.Errorf("squashfs: invalid owner %d:%d", hdr.Uid, hdr.Gid)
+	}
+	opts := []EntryOption{WithOwner(uint32(hdr.Uid), uint32(hdr.Gid))}
+	for key, value := range hdr.PAXRecords {
+		if xattr, ok := strings.CutPrefix(key, paxXattrPrefix); ok {
+			opts = append(opts, WithXattr(xattr, []byte(value)))
+		}
+	}
+	mode := hdr.FileInfo().Mode()
+
+	if hdr.Typeflag == tar.TypeDir {
+		if name == "" {
+			if !d.implicit {
+				return nil // keep the attributes of d
+			}
+			return d.setAttributes(hdr.ModTime, mode, opts, false)
+		}
+		// Archives may contain the same directory more than once (e.g. when
+		// concatenating archives); the last entry wins, like with tar(1).
+		if err := d.addDirectory(name, hdr.ModTime, mode, opts, true); err != nil {
+			return err
+		}
+		if flusher != nil {
+			sub, err := d.lookupDir(name)
+			if err != nil {
+				return err
+			}
+			flusher.enter(name, sub)
+		}
+		return nil
+	}
+	if name == "" {
+		return fmt.Errorf("squashfs: unexpected type %q for the archive root", hdr.Typeflag)
+	}
+	parent, base, err := d.parentDir(name)
+	if err != nil {
+		return err
+	}
+	switch hdr.Typeflag {
+	case tar.TypeReg:
+		f, err := parent.File(base, hdr.ModTime, mode, opts...)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, r); err != nil {
+			return err
+		}
+		return f.Close()
+
+	case tar.TypeSymlink:
+		return parent.Symlink(hdr.Linkname, base, hdr.ModTime, mode, opts...)
+
+	case tar.TypeLink:
+		target, err := cleanTarPath(hdr.Linkname)
+		if err != nil {
+			return err
+		}
+		if target == "" {
+			return fmt.Errorf("squashfs: hard link to the archive root")
+		}
+		return parent.Link(base, d.path(target))
+
+	case tar.TypeChar, tar.TypeBlock:
+		if hdr.Devmajor < 0 || hdr.Devmajor > math.MaxUint32 || hdr.Devminor < 0 || hdr.Devminor > math.MaxUint32 {
+			return fmt.Errorf("squashfs: invalid device number %d:%d", hdr.Devmajor, hdr.Devminor)
+		}
+		return parent.Device(base, uint32(hdr.Devmajor), uint32(hdr.Devminor), hdr.ModTime, mode, opts...)
+
+	case tar.TypeFifo:
+		return parent.Fifo(base, hdr.ModTime, mode, opts...)
+
+	default:
+		return fmt.Errorf("squashfs: unsupported type %q", hdr.Typeflag)
+	}
+}
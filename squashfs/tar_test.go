@@ -0,0 +1,229 @@
+package squashfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func writeTestTar(t *testing.T, entries []tar.Header, contents map[string]string) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range entries {
+		hdr.Size = int64(len(contents[hdr.Name]))
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(contents[hdr.Name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestWriteTar(t *testing.T) {
+	t.Parallel()
+
+	mtime := time.Unix(1234567890, 0)
+	archive := writeTestTar(t, []tar.Header{
+		{Name: "./", Typeflag: tar.TypeDir, Mode: 0o750, ModTime: mtime},
+		{Name: "./bin/", Typeflag: tar.TypeDir, Mode: 0o755, ModTime: mtime},
+		{Name: "./bin/busybox", Typeflag: tar.TypeReg, Mode: 0o4755, ModTime: mtime, PAXRecords: map[string]string{
+			"SCHILY.xattr.user.origin": "gokrazy",
+		}},
+		{Name: "./bin/sh", Typeflag: tar.TypeLink, Linkname: "./bin/busybox", ModTime: mtime},
+		{Name: "./bin/ls", Typeflag: tar.TypeSymlink, Linkname: "busybox", Mode: 0o777, ModTime: mtime},
+		{Name: "./dev/null", Typeflag: tar.TypeChar, Devmajor: 1, Devminor: 3, Mode: 0o666, ModTime: mtime},
+		{Name: "./dev/sda", Typeflag: tar.TypeBlock, Devmajor: 8, Devminor: 0, Mode: 0o660, Gid: 6, ModTime: mtime},
+		{Name: "./home/user/", Typeflag: tar.TypeDir, Mode: 0o700, Uid: 1000, Gid: 1000, ModTime: mtime},
+		{Name: "./home/user/notes", Typeflag: tar.TypeReg, Mode: 0o600, Uid: 1000, Gid: 1000, ModTime: mtime},
+		{Name: "./run/initctl", Typeflag: tar.TypeFifo, Mode: 0o600, ModTime: mtime},
+		{Name: "./bin/", Typeflag: tar.TypeDir, Mode: 0o555, ModTime: mtime}, // duplicate
+	}, map[string]string{
+		"./bin/busybox":     "busybox binary",
+		"./home/user/notes": "remember the milk",
+	})
+
+	f := writeTestImage(t, func(w *Writer) {
+		// Extract the archive into a subtree of the image.
+		sub := addTestDirectory(t, w.Root, "sub", mtime, 0o755)
+		if err := WriteTar(sub, archive); err != nil {
+			t.Fatal(err)
+		}
+	})
+	r, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(r,
+		"sub/bin/busybox",
+		"sub/bin/ls",
+		"sub/bin/sh",
+		"sub/dev/null",
+		"sub/dev/sda",
+		"sub/home/user/notes",
+		"sub/run/initctl"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := fs.ReadFile(r, "sub/bin/ls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "busybox binary"; string(got) != want {
+		t.Errorf("sub/bin/ls: got %q, want %q", got, want)
+	}
+	for _, entry := range []struct {
+		path            string
+		mode            fs.FileMode
+		uid, gid, nlink uint32
+		major, minor    uint32
+	}{
+		{path: "sub", mode: 0o755 | fs.ModeDir, nlink: 6},
+		{path: "sub/bin", mode: 0o555 | fs.ModeDir, nlink: 2},
+		{path: "sub/bin/busybox", mode: 0o755 | fs.ModeSetuid, nlink: 2},
+		{path: "sub/bin/sh", mode: 0o755 | fs.ModeSetuid, nlink: 2},
+		{path: "sub/bin/ls", mode: 0o777 | fs.ModeSymlink, nlink: 1},
+		{path: "sub/dev/null", mode: 0o666 | fs.ModeDevice | fs.ModeCharDevice, nlink: 1, major: 1, minor: 3},
+		{path: "sub/dev/sda", mode: 0o660 | fs.ModeDevice, gid: 6, nlink: 1, major: 8},
+		{path: "sub/home/user", mode: 0o700 | fs.ModeDir, uid: 1000, gid: 1000, nlink: 2},
+		{path: "sub/home/user/notes", mode: 0o600, uid: 1000, gid: 1000, nlink: 1},
+		{path: "sub/run/initctl", mode: 0o600 | fs.ModeNamedPipe, nlink: 1},
+	} {
+		fi, err := r.Lstat(entry.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := fi.Mode(), entry.mode; got != want {
+			t.Errorf("%s: unexpected mode: got %v, want %v", entry.path, got, want)
+		}
+		if got, want := fi.ModTime(), mtime; !got.Equal(want) {
+			t.Errorf("%s: unexpected mtime: got %v, want %v", entry.path, got, want)
+		}
+		st := fi.Sys().(*Stat)
+		if st.Uid != entry.uid || st.Gid != entry.gid {
+			t.Errorf("%s: unexpected owner: got %d:%d, want %d:%d", entry.path, st.Uid, st.Gid, entry.uid, entry.gid)
+		}
+		if st.Nlink != entry.nlink {
+			t.Errorf("%s: unexpected link count: got %d, want %d", entry.path, st.Nlink, entry.nlink)
+		}
+		if st.Major() != entry.major || st.Minor() != entry.minor {
+			t.Errorf("%s: unexpected device number: got %d:%d, want %d:%d", entry.path, st.Major(), st.Minor(), entry.major, entry.minor)
+		}
+	}
+	xattrs, err := r.Xattrs("sub/bin/sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(xattrs) != 1 || xattrs[0].Name != "user.origin" || string(xattrs[0].Value) != "gokrazy" {
+		t.Errorf("sub/bin/sh: unexpected xattrs %v", xattrs)
+	}
+}
+
+func TestWriteTarErrors(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		desc    string
+		entries []tar.Header
+		want    string
+	}{
+		{
+			desc:    "path traversal",
+			entries: []tar.Header{{Name: "../etc/passwd", Typeflag: tar.TypeReg, Mode: 0o644}},
+			want:    "leaves the archive root",
+		},
+		{
+			desc:    "unsupported type",
+			entries: []tar.Header{{Name: "contiguous", Typeflag: tar.TypeCont, Mode: 0o644}},
+			want:    "unsupported type",
+		},
+		{
+			desc:    "missing hard link target",
+			entries: []tar.Header{{Name: "link", Typeflag: tar.TypeLink, Linkname: "nonexistent"}},
+			want:    "not found",
+		},
+		{
+			desc: "unsupported xattr",
+			entries: []tar.Header{{Name: "acl", Typeflag: tar.TypeReg, Mode: 0o644, PAXRecords: map[string]string{
+				"SCHILY.xattr.system.posix_acl_access": "x",
+			}}},
+			want: "unsupported xattr",
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			archive := writeTestTar(t, tt.entries, nil)
+			writeTestImage(t, func(w *Writer) {
+				err := WriteTar(w.Root, archive)
+				if err == nil || !strings.Contains(err.Error(), tt.want) {
+					t.Errorf("WriteTar = %v, want error containing %q", err, tt.want)
+				}
+			})
+		})
+	}
+}
+
+func TestWriteTarFlush(t *testing.T) {
+	t.Parallel()
+
+	mtime := time.Unix(1234567890, 0)
+	archive := writeTestTar(t, []tar.Header{
+		{Name: "./bin/", Typeflag: tar.TypeDir, Mode: 0o755, ModTime: mtime},
+		{Name: "./bin/busybox", Typeflag: tar.TypeReg, Mode: 0o755, ModTime: mtime},
+		{Name: "./bin/sh", Typeflag: tar.TypeLink, Linkname: "./bin/busybox", ModTime: mtime},
+		{Name: "./etc/", Typeflag: tar.TypeDir, Mode: 0o755, ModTime: mtime},
+		{Name: "./etc/hostname", Typeflag: tar.TypeReg, Mode: 0o644, ModTime: mtime},
+		{Name: "./usr/bin/", Typeflag: tar.TypeDir, Mode: 0o755, ModTime: mtime},
+		{Name: "./usr/bin/x", Typeflag: tar.TypeReg, Mode: 0o755, ModTime: mtime},
+	}, map[string]string{
+		"./bin/busybox":  "busybox binary",
+		"./etc/hostname": "gokrazy\n",
+	})
+	f := writeTestImage(t, func(w *Writer) {
+		if err := WriteTar(w.Root, archive, WithTarFlush()); err != nil {
+			t.Fatal(err)
+		}
+		for _, dir := range []*Directory{
+			w.Root.subdirByName["bin"],
+			w.Root.subdirByName["etc"],
+			w.Root.subdirByName["usr"].subdirByName["bin"],
+		} {
+			if !dir.flushed {
+				t.Errorf("directory %s not flushed by WriteTar", dir.fullPath())
+			}
+		}
+	})
+	r, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(r, "bin/busybox", "bin/sh", "etc/hostname", "usr/bin/x"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Hard links to directories which the archive left cannot be created.
+	entries := []tar.Header{
+		{Name: "a/", Typeflag: tar.TypeDir, Mode: 0o755, ModTime: mtime},
+		{Name: "a/file", Typeflag: tar.TypeReg, Mode: 0o644, ModTime: mtime},
+		{Name: "b/", Typeflag: tar.TypeDir, Mode: 0o755, ModTime: mtime},
+		{Name: "b/link", Typeflag: tar.TypeLink, Linkname: "a/file", ModTime: mtime},
+	}
+	writeTestImage(t, func(w *Writer) {
+		if err := WriteTar(w.Root, writeTestTar(t, entries, nil)); err != nil {
+			t.Fatal(err)
+		}
+	})
+	writeTestImage(t, func(w *Writer) {
+		err := WriteTar(w.Root, writeTestTar(t, entries, nil), WithTarFlush())
+		if err == nil || !strings.Contains(err.Error(), "already flushed") {
+			t.Errorf("WriteTar = %v, want error containing %q", err, "already flushed")
+		}
+	})
+}
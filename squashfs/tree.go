@@ -0,0 +1,279 @@
+package squashfs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// splitPath cleans the slash-separated path name (relative to the file system
+// root, with or without a leading slash) and returns its parent directory and
+// base name.
+func splitPath(name string) (dir, base string, err error) {
+	p := strings.TrimPrefix(path.Clean("/"+name), "/")
+	if p == "" {
+		return "", "", fmt.Errorf("squashfs: invalid path %q", name)
+	}
+	dir, base = path.Split(p)
+	return strings.TrimSuffix(dir, "/"), base, nil
+}
+
+// fullPath returns the absolute slash-separated path of d.
+func (d *Directory) fullPath() string {
+	if d.parent == nil {
+		return "/"
+	}
+	return "/" + d.parent.path(d.name)
+}
+
+// lookupDir returns the directory with the specified slash-separated path
+// (relative to d, "" for d itself), creating missing directories with mode
+// 0755 and the modification time of Root.
+func (d *Directory) lookupDir(dir string) (*Directory, error) {
+	if dir == "" {
+		return d, nil
+	}
+	for _, name := range strings.Split(dir, "/") {
+		sub, ok := d.subdirByName[name]
+		if !ok {
+			var err error
+			sub, err = d.Directory(name, d.w.Root.modTime, 0o755)
+			if err != nil {
+				return nil, err
+			}
+			sub.implicit = true
+		}
+		d = sub
+	}
+	if err := d.checkFlushed(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// AddDirectory creates the directory with the slash-separated path name
+// (e.g. "/usr/bin") and the specified modTime and mode, creating missing
+// parent directories. If the directory was already created implicitly as the
+// parent of another entry, its attributes are updated instead. Specifying the
+// path "/" sets the attributes of Root.
+func (w *Writer) AddDirectory(name string, modTime time.Time, mode os.FileMode, opts ...EntryOption) error {
+	return w.Root.addDirectory(name, modTime, mode, opts, false)
+}
+
+// addDirectory creates the directory with the slash-separated path name
+// relative to d, see Writer.AddDirectory. If overwrite is true, the attributes
+// of existing directories are updated, even if they were created explicitly.
+func (d *Directory) addDirectory(name string, modTime time.Time, mode os.FileMode, opts []EntryOption, overwrite bool) error {
+	p := strings.TrimPrefix(path.Clean("/"+name), "/")
+	if p == "" {
+		return d.setAttributes(modTime, mode, opts, overwrite)
+	}
+	dir, base, err := splitPath(p)
+	if err != nil {
+		return err
+	}
+	parent, err := d.lookupDir(dir)
+	if err != nil {
+		return err
+	}
+	if sub, ok := parent.subdirByName[base]; ok {
+		return sub.setAttributes(modTime, mode, opts, overwrite)
+	}
+	_, err = parent.Directory(base, modTime, mode, opts...)
+	return err
+}
+
+// setAttributes sets the attributes of an implicitly created directory (or,
+// if overwrite is true, of any directory).
+func (d *Directory) setAttributes(modTime time.Time, mode os.FileMode, opts []EntryOption, overwrite bool) error {
+	if !d.implicit && !overwrite {
+		return fmt.Errorf("squashfs: directory %q already exists", d.fullPath())
+	}
+	if err := d.checkFlushed(); err != nil {
+		return err
+	}
+	if _, err := d.w.mtime(modTime); err != nil {
+		return err
+	}
+	attrs, err := d.w.inodeAttrs(opts)
+	if err != nil {
+		return err
+	}
+	d.modTime = modTime
+	d.mode = mode
+	d.attrs = attrs
+	d.implicit = false
+	return nil
+}
+
+// AddFile creates a file with the slash-separated path name (e.g.
+// "/usr/bin/x") and the specified modTime and mode, creating missing parent
+// directories. The returned io.WriteCloser must be closed after writing the
+// file.
+func (w *Writer) AddFile(name string, modTime time.Time, mode os.FileMode, opts ...EntryOption) (io.WriteCloser, error) {
+	dir, base, err := w.Root.parentDir(name)
+	if err != nil {
+		return nil, err
+	}
+	return dir.File(base, modTime, mode, opts...)
+}
+
+// AddSymlink creates a symbolic link with the slash-separated path newname,
+// pointing to oldname, creating missing parent directories.
+func (w *Writer) AddSymlink(oldname, newname string, modTime time.Time, mode os.FileMode, opts ...EntryOption) error {
+	dir, base, err := w.Root.parentDir(newname)
+	if err != nil {
+		return err
+	}
+	return dir.Symlink(oldname, base, modTime, mode, opts...)
+}
+
+// AddDevice creates a device node with the slash-separated path name, creating
+// missing parent directories. See Directory.Device.
+func (w *Writer) AddDevice(name string, major, minor uint32, modTime time.Time, mode os.FileMode, opts ...EntryOption) error {
+	dir, base, err := w.Root.parentDir(name)
+	if err != nil {
+		return err
+	}
+	return dir.Device(base, major, minor, modTime, mode, opts...)
+}
+
+// AddFifo creates a named pipe with the slash-separated path name, creating
+// missing parent directories.
+func (w *Writer) AddFifo(name string, modTime time.Time, mode os.FileMode, opts ...EntryOption) error {
+	dir, base, err := w.Root.parentDir(name)
+	if err != nil {
+		return err
+	}
+	return dir.Fifo(base, modTime, mode, opts...)
+}
+
+// AddSocket creates a unix domain socket with the slash-separated path name,
+// creating missing parent directories.
+func (w *Writer) AddSocket(name string, modTime time.Time, mode os.FileMode, opts ...EntryOption) error {
+	dir, base, err := w.Root.parentDir(name)
+	if err != nil {
+		return err
+	}
+	return dir.Socket(base, modTime, mode, opts...)
+}
+
+type pendingLink struct {
+	dir          *Directory
+	name, target string
+}
+
+// AddLink creates a hard link with the slash-separated path name, referring to
+// the non-directory target (a slash-separated path, too), creating missing
+// parent directories. Unlike Directory.Link, the link is resolved in Flush, so
+// target does not need to exist yet.
+func (w *Writer) AddLink(name, target string) error {
+	dir, base, err := w.Root.parentDir(name)
+	if err != nil {
+		return err
+	}
+	w.pendingLinks = append(w.pendingLinks, pendingLink{
+		dir:    dir,
+		name:   base,
+		target: target,
+	})
+	return nil
+}
+
+// resolveLinks creates the hard links added by AddLink. Links whose target is
+// another pending link are resolved once that link was created.
+func (w *Writer) resolveLinks() error {
+	for len(w.pendingLinks) > 0 {
+		var unresolved []pendingLink
+		for _, l := range w.pendingLinks {
+			if _, ok := w.linkTargets[strings.TrimPrefix(path.Clean("/"+l.target), "/")]; !ok {
+				unresolved = append(unresolved, l)
+				continue
+			}
+			if err := l.dir.Link(l.name, l.target); err != nil {
+				return err
+			}
+		}
+		if len(unresolved) == len(w.pendingLinks) {
+			// No progress: the targets do not exist (or form a cycle).
+			l := unresolved[0]
+			return l.dir.Link(l.name, l.target)
+		}
+		w.pendingLinks = unresolved
+	}
+	return nil
+}
+
+// parentDir returns the parent directory of the slash-separated path name
+// relative to d (creating it if necessary) and the base name.
+func (d *Directory) parentDir(name string) (*Directory, string, error) {
+	dir, base, err := splitPath(name)
+	if err != nil {
+		return nil, "", err
+	}
+	parent, err := d.lookupDir(dir)
+	if err != nil {
+		return nil, "", err
+	}
+	return parent, base, nil
+}
+
+// flushFinished flushes d, whose entries were all added by a traversal (see
+// walkFlusher). d is kept (and flushed by Writer.Flush) if a hard link which
+// AddLink has not resolved yet is located in d or refers to an entry within d,
+// as the link could not be created otherwise.
+func (w *Writer) flushFinished(d *Directory) error {
+	if d.flushed {
+		return nil
+	}
+	p := d.fullPath()
+	within := func(name string) bool {
+		return name == p || strings.HasPrefix(name, p+"/")
+	}
+	for _, l := range w.pendingLinks {
+		if within(l.dir.fullPath()) || within(path.Clean("/"+l.target)) {
+			return nil
+		}
+	}
+	return d.Flush()
+}
+
+// walkFlusher flushes the directories of a depth-first traversal (e.g.
+// fs.WalkDir) once the traversal has left them, so that their entries do not
+// remain in memory until Writer.Flush.
+type walkFlusher struct {
+	w *Writer
+
+	// stack contains the directories being traversed, outermost first.
+	stack []walkDir
+}
+
+type walkDir struct {
+	path string // slash-separated path in the traversal
+	dir  *Directory
+}
+
+// enter records that the traversal entered the directory at path p, which is
+// dir in the image.
+func (f *walkFlusher) enter(p string, dir *Directory) {
+	f.stack = append(f.stack, walkDir{path: p, dir: dir})
+}
+
+// visit flushes all directories which do not contain the entry at path p,
+// which the traversal visits next. Use visit("") once the traversal is done.
+func (f *walkFlusher) visit(p string) error {
+	for len(f.stack) > 0 {
+		top := f.stack[len(f.stack)-1]
+		if p != "" && (p == top.path || strings.HasPrefix(p, top.path+"/")) {
+			break
+		}
+		f.stack = f.stack[:len(f.stack)-1]
+		if err := f.w.flushFinished(top.dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+package squashfs
+
+import (
+	"bytes"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestAddPaths(t *testing.T) {
+	t.Parallel()
+
+	mtime := time.Unix(1234567890, 0)
+	addFile := func(t *testing.T, w *Writer, name string, contents string) {
+		t.Helper()
+		f, err := w.AddFile(name, mtime, 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte(contents)); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f := writeTestImage(t, func(w *Writer) {
+		// Deliberately add entries in unsorted order, without flushing any
+		// directories explicitly.
+		// rsh refers to sh, which is a link itself.
+		if err := w.AddLink("/usr/bin/rsh", "/usr/bin/sh"); err != nil {
+			t.Fatal(err)
+		}
+		addFile(t, w, "/usr/bin/zsh", "zsh")
+		if err := w.AddLink("usr/bin/sh", "/usr/bin/zsh"); err != nil {
+			t.Fatal(err)
+		}
+		addFile(t, w, "/usr/bin/bash", "bash")
+		if err := w.AddSymlink("usr/bin", "/bin", mtime, 0o777); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.AddDirectory("/usr", mtime, 0o750, WithOwner(0, 1000)); err != nil {
+			t.Fatal(err)
+		}
+		addFile(t, w, "/etc/hostname", "gokrazy\n")
+		if err := w.AddLink("/etc/hostname.bak", "/etc/hostname"); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.AddDirectory("/", mtime, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.AddFifo("/run/initctl", mtime, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.AddDirectory("/usr", mtime, 0o755); err == nil {
+			t.Errorf("AddDirectory(/usr) twice unexpectedly succeeded")
+		}
+
+		// The Directory API can be mixed in, also without sorting.
+		dev := addTestDirectory(t, w.Root, "dev", mtime, 0o755)
+		if err := dev.Device("null", 1, 3, mtime, 0o666|fs.ModeDevice|fs.ModeCharDevice); err != nil {
+			t.Fatal(err)
+		}
+		if err := dev.Device("console", 5, 1, mtime, 0o600|fs.ModeDevice|fs.ModeCharDevice); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	r, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(r,
+		"bin",
+		"dev/console",
+		"dev/null",
+		"etc/hostname",
+		"etc/hostname.bak",
+		"run/initctl",
+		"usr/bin/bash",
+		"usr/bin/rsh",
+		"usr/bin/sh",
+		"usr/bin/zsh"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := fs.ReadFile(r, "usr/bin/sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, []byte("zsh")) {
+		t.Errorf("usr/bin/sh: got %q, want %q", got, "zsh")
+	}
+	for _, entry := range []struct {
+		path  string
+		mode  fs.FileMode
+		nlink uint32
+	}{
+		{".", 0o755 | fs.ModeDir, 6},
+		{"usr", 0o750 | fs.ModeDir, 3},
+		{"usr/bin/sh", 0o755, 3},
+		{"run", 0o755 | fs.ModeDir, 2},
+	} {
+		fi, err := r.Lstat(entry.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := fi.Mode(), entry.mode; got != want {
+			t.Errorf("%s: unexpected mode: got %v, want %v", entry.path, got, want)
+		}
+		if got, want := fi.Sys().(*Stat).Nlink, entry.nlink; got != want {
+			t.Errorf("%s: unexpected link count: got %d, want %d", entry.path, got, want)
+		}
+	}
+	if fi, err := r.Stat("usr"); err != nil {
+		t.Fatal(err)
+	} else if got, want := fi.Sys().(*Stat).Gid, uint32(1000); got != want {
+		t.Errorf("usr: unexpected gid: got %d, want %d", got, want)
+	}
+}
+
+func TestAddDuplicate(t *testing.T) {
+	t.Parallel()
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "squashfs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w, err := NewWriter(f, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AddSymlink("a", "/etc/x", time.Now(), 0o777); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AddFifo("/etc/x", time.Now(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err == nil || !strings.Contains(err.Error(), "duplicate") {
+		t.Errorf("Flush = %v, want duplicate directory entry error", err)
+	}
+}
+
+func TestAddLinkUnresolvable(t *testing.T) {
+	t.Parallel()
+
+	for _, links := range [][][2]string{
+		{{"/a", "/nonexistent"}},
+		{{"/a", "/b"}, {"/b", "/a"}},
+	} {
+		f, err := os.Create(filepath.Join(t.TempDir(), "squashfs"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		w, err := NewWriter(f, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, l := range links {
+			if err := w.AddLink(l[0], l[1]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Flush(); err == nil {
+			t.Errorf("Flush with links %v unexpectedly succeeded", links)
+		}
+	}
+}
+
+func TestFlushedDirectory(t *testing.T) {
+	t.Parallel()
+
+	mtime := time.Unix(1234567890, 0)
+	f := writeTestImage(t, func(w *Writer) {
+		etc := addTestDirectory(t, w.Root, "etc", mtime, 0o755)
+		writeTestFile(t, etc, "hostname", 0o644, []byte("gokrazy\n"))
+		late, err := etc.File("late", mtime, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := etc.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := etc.Flush(); err == nil {
+			t.Errorf("Flush twice unexpectedly succeeded")
+		}
+		if _, err := etc.Directory("ssl", mtime, 0o755); err == nil {
+			t.Errorf("Directory in flushed directory unexpectedly succeeded")
+		}
+		if _, err := etc.File("passwd", mtime, 0o644); err == nil {
+			t.Errorf("File in flushed directory unexpectedly succeeded")
+		}
+		if err := late.Close(); err == nil {
+			t.Errorf("Close of a file in a flushed directory unexpectedly succeeded")
+		}
+		if err := etc.Symlink("hostname", "link", mtime, 0o777); err == nil {
+			t.Errorf("Symlink in flushed directory unexpectedly succeeded")
+		}
+		if err := etc.Device("null", 1, 3, mtime, 0o666|fs.ModeDevice|fs.ModeCharDevice); err == nil {
+			t.Errorf("Device in flushed directory unexpectedly succeeded")
+		}
+		if err := etc.Fifo("fifo", mtime, 0o600); err == nil {
+			t.Errorf("Fifo in flushed directory unexpectedly succeeded")
+		}
+		if err := etc.Socket("socket", mtime, 0o600); err == nil {
+			t.Errorf("Socket in flushed directory unexpectedly succeeded")
+		}
+		if err := etc.Link("hostname.bak", "/run/x"); err == nil {
+			t.Errorf("Link in flushed directory unexpectedly succeeded")
+		}
+		if _, err := w.AddFile("/etc/ssl/certs", mtime, 0o644); err == nil {
+			t.Errorf("AddFile in flushed directory unexpectedly succeeded")
+		}
+		// The image (checked by writeTestImage) only contains entries which
+		// were added successfully.
+	})
+
+	r, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(r, "etc/hostname"); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := r.ReadDir("etc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("ReadDir(etc) = %v, want only hostname", entries)
+	}
+}
+
+func TestDirectoryFlushError(t *testing.T) {
+	t.Parallel()
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "squashfs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w, err := NewWriter(f, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	etc := addTestDirectory(t, w.Root, "etc", time.Now(), 0o755)
+	for i := 0; i < 2; i++ {
+		if err := etc.Fifo("fifo", time.Now(), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := etc.Flush(); err == nil {
+		t.Fatalf("Flush of a directory with duplicate entries unexpectedly succeeded")
+	}
+	// Even if the error is ignored, the image must not be written without
+	// the directory.
+	if err := w.Flush(); err == nil {
+		t.Errorf("Writer.Flush after a failed Directory.Flush unexpectedly succeeded")
+	}
+}
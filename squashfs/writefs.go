@@ -0,0 +1,177 @@
+package squashfs
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// FSEntry describes a file system entry which WriteFS is about to add to the
+// image. The Hook in WriteFSOptions can modify all fields.
+type FSEntry struct {
+	// Path is the slash-separated path of the entry in the image, e.g.
+	// "usr/bin/x". It is "." for the root directory.
+	Path string
+
+	// Mode contains the type and permission bits of the entry.
+	Mode fs.FileMode
+
+	// ModTime is the modification time of the entry.
+	ModTime time.Time
+
+	// Target is the target of symbolic links.
+	Target string
+
+	// Options are passed when creating the entry, e.g. WithOwner.
+	Options []EntryOption
+}
+
+// WriteFSOptions configures WriteFS.
+type WriteFSOptions struct {
+	// ClampTime, if non-zero, is the latest modification time stored in the
+	// image: later modification times are replaced with ClampTime.
+	ClampTime time.Time
+
+	// Hook, if non-nil, is called for each entry before it is added to the
+	// image, and can modify the entry. If Hook returns false, the entry (and
+	// for directories, all of its contents) is skipped. Changing the Path of
+	// a directory does not affect the paths of its contents. Hook is not
+	// called for the root directory.
+	Hook func(e *FSEntry) (bool, error)
+
+	// KeepDirectories disables flushing directories once all of their entries
+	// were added, e.g. to add more entries to them after WriteFS returns.
+	KeepDirectories bool
+}
+
+// readLinkFS is implemented by file systems which support symbolic links, such
+// as *Reader and the file system returned by DirFS.
+type readLinkFS interface {
+	fs.FS
+	ReadLink(name string) (string, error)
+}
+
+// WriteFS adds all files, directories and symbolic links of fsys to the image
+// written by w, keeping their modes and modification times. Symbolic links are
+// only supported if fsys implements a ReadLink method (like Reader and the
+// file system returned by DirFS). Other file types result in an error.
+//
+// As fs.WalkDir visits entries in lexical order, WriteFS flushes each
+// directory (except for the root directory) once all of its entries were
+// added, unless KeepDirectories is set. Entries can no longer be added to
+// these directories afterwards, e.g. by a Hook which changes the Path of an
+// entry to a directory which fs.WalkDir already left. WriteFS does not flush w.
+func WriteFS(w *Writer, fsys fs.FS, opts WriteFSOptions) error {
+	flusher := &walkFlusher{w: w}
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !opts.KeepDirectories {
+			if err := flusher.visit(name); err != nil {
+				return err
+			}
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		e := &FSEntry{
+			Path:    name,
+			Mode:    info.Mode(),
+			ModTime: info.ModTime(),
+		}
+		if e.Mode.Type() == fs.ModeSymlink {
+			rfs, ok := fsys.(readLinkFS)
+			if !ok {
+				return fmt.Errorf("squashfs: %s: file system does not support symbolic links", name)
+			}
+			if e.Target, err = rfs.ReadLink(name); err != nil {
+				return err
+			}
+		}
+		if name != "." && opts.Hook != nil {
+			keep, err := opts.Hook(e)
+			if err != nil {
+				return err
+			}
+			if !keep {
+				if d.IsDir() {
+					return fs.SkipDir
+				}
+				return nil
+			}
+		}
+		if !opts.ClampTime.IsZero() && e.ModTime.After(opts.ClampTime) {
+			e.ModTime = opts.ClampTime
+		}
+		if err := w.addFSEntry(fsys, name, e); err != nil {
+			return err
+		}
+		if !opts.KeepDirectories && name != "." && e.Mode.IsDir() {
+			dir, err := w.Root.lookupDir(strings.TrimPrefix(path.Clean("/"+e.Path), "/"))
+			if err != nil {
+				return err
+			}
+			flusher.enter(name, dir)
+		}
+		return nil
+	})
+	if err != nil || opts.KeepDirectories {
+		return err
+	}
+	return flusher.visit("")
+}
+
+// addFSEntry adds e, whose contents are read from name in fsys.
+func (w *Writer) addFSEntry(fsys fs.FS, name string, e *FSEntry) error {
+	p := path.Clean("/" + e.Path)
+	switch e.Mode.Type() {
+	case fs.ModeDir:
+		return w.AddDirectory(p, e.ModTime, e.Mode, e.Options...)
+
+	case fs.ModeSymlink:
+		return w.AddSymlink(e.Target, p, e.ModTime, e.Mode, e.Options...)
+
+	case 0: // regular file
+		f, err := fsys.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		ff, err := w.AddFile(p, e.ModTime, e.Mode, e.Options...)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(ff, f); err != nil {
+			return err
+		}
+		return ff.Close()
+
+	default:
+		return fmt.Errorf("squashfs: %s: unsupported file type %v", name, e.Mode.Type())
+	}
+}
+
+// DirFS returns a file system for the host directory tree rooted at dir,
+// which, unlike os.DirFS, supports reading symbolic links.
+func DirFS(dir string) fs.FS {
+	return dirFS{FS: os.DirFS(dir), dir: dir}
+}
+
+type dirFS struct {
+	fs.FS
+	dir string
+}
+
+func (d dirFS) ReadLink(name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return os.Readlink(filepath.Join(d.dir, filepath.FromSlash(name)))
+}
@@ -0,0 +1,170 @@
+package squashfs
+
+import (
+	"bytes"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestWriteFS(t *testing.T) {
+	t.Parallel()
+
+	old := time.Unix(1234567890, 0)
+	clamp := time.Unix(1500000000, 0)
+	src := t.TempDir()
+	for _, dir := range []string{"etc/ssl", "usr/bin", "var/cache"} {
+		if err := os.MkdirAll(filepath.Join(src, dir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []struct {
+		name     string
+		mode     os.FileMode
+		contents string
+	}{
+		{"etc/hostname", 0o644, "gokrazy\n"},
+		{"etc/ssl/key.pem", 0o600, "secret"},
+		{"usr/bin/httpd", 0o755, "#!/bin/sh\n"},
+		{"var/cache/junk", 0o644, "junk"},
+	} {
+		fn := filepath.Join(src, file.name)
+		if err := os.WriteFile(fn, []byte(file.contents), file.mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(fn, file.mode); err != nil { // not subject to umask
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(filepath.Join(src, "etc/ssl"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filepath.Join(src, "etc/hostname"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/usr/bin/httpd", filepath.Join(src, "httpd")); err != nil {
+		t.Fatal(err)
+	}
+
+	f := writeTestImage(t, func(w *Writer) {
+		if err := WriteFS(w, DirFS(src), WriteFSOptions{
+			ClampTime: clamp,
+			Hook: func(e *FSEntry) (bool, error) {
+				switch e.Path {
+				case "var/cache":
+					return false, nil
+				case "usr/bin/httpd":
+					e.Options = append(e.Options, WithCapabilities(CapNetBindService))
+				case "etc/hostname":
+					e.Path = "etc/hostname.orig"
+				}
+				return true, nil
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	r, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(r, "etc/hostname.orig", "etc/ssl/key.pem", "httpd", "usr/bin/httpd"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Stat("var/cache"); err == nil {
+		t.Errorf("var/cache unexpectedly present in image")
+	}
+	got, err := fs.ReadFile(r, "httpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, []byte("#!/bin/sh\n")) {
+		t.Errorf("httpd: got %q, want %q", got, "#!/bin/sh\n")
+	}
+	for _, entry := range []struct {
+		path    string
+		mode    fs.FileMode
+		modTime time.Time
+	}{
+		{"etc/hostname.orig", 0o644, old},
+		{"etc/ssl", 0o700 | fs.ModeDir, clamp},
+		{"etc/ssl/key.pem", 0o600, clamp},
+		{"usr/bin/httpd", 0o755, clamp},
+		{"httpd", 0o777 | fs.ModeSymlink, clamp},
+	} {
+		fi, err := r.Lstat(entry.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := fi.Mode(), entry.mode; got != want {
+			t.Errorf("%s: unexpected mode: got %v, want %v", entry.path, got, want)
+		}
+		if got, want := fi.ModTime(), entry.modTime; !got.Equal(want) {
+			t.Errorf("%s: unexpected mtime: got %v, want %v", entry.path, got, want)
+		}
+	}
+	xattrs, err := r.Xattrs("usr/bin/httpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(xattrs) != 1 || xattrs[0].Name != "security.capability" {
+		t.Errorf("usr/bin/httpd: unexpected xattrs %v", xattrs)
+	}
+}
+
+func TestWriteFSUnsupported(t *testing.T) {
+	t.Parallel()
+
+	fsys := fstest.MapFS{
+		"dev/null": &fstest.MapFile{Mode: 0o666 | fs.ModeDevice | fs.ModeCharDevice},
+	}
+	writeTestImage(t, func(w *Writer) {
+		err := WriteFS(w, fsys, WriteFSOptions{})
+		if err == nil || !strings.Contains(err.Error(), "unsupported file type") {
+			t.Errorf("WriteFS = %v, want unsupported file type error", err)
+		}
+	})
+}
+
+func TestWriteFSFlush(t *testing.T) {
+	t.Parallel()
+
+	fsys := fstest.MapFS{
+		"a/b/file": &fstest.MapFile{Data: []byte("a/b/file"), Mode: 0o644},
+		"c/file":   &fstest.MapFile{Data: []byte("c/file"), Mode: 0o644},
+		"d/file":   &fstest.MapFile{Data: []byte("d/file"), Mode: 0o644},
+	}
+	f := writeTestImage(t, func(w *Writer) {
+		// Directories containing (targets of) unresolved hard links remain.
+		if err := w.AddLink("/d/link", "c/file"); err != nil {
+			t.Fatal(err)
+		}
+		if err := WriteFS(w, fsys, WriteFSOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		for name, want := range map[string]bool{"a": true, "c": false, "d": false} {
+			if got := w.Root.subdirByName[name].flushed; got != want {
+				t.Errorf("directory %s: flushed = %v, want %v", name, got, want)
+			}
+		}
+	})
+	r, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(r, "a/b/file", "c/file", "d/file", "d/link"); err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestImage(t, func(w *Writer) {
+		if err := WriteFS(w, fsys, WriteFSOptions{KeepDirectories: true}); err != nil {
+			t.Fatal(err)
+		}
+		writeTestFile(t, w.Root.subdirByName["a"], "extra", 0o644, nil)
+	})
+}
@@ -1,22 +1,45 @@
-// Package squashfs implements writing SquashFS file system images using zlib
-// compression for data blocks (inodes and directory entries are written
-// uncompressed for simplicity).
+// Package squashfs implements writing SquashFS file system images. By default,
+// data blocks are compressed using zlib (see WithCompressor for alternatives)
+// and inodes and directory entries are written uncompressed for simplicity
+// (see WithMetadataCompression). The tail ends of files are packed into shared
+// fragment blocks, and the contents of identical files are stored only once.
+// All-zero blocks are stored as holes (sparse files).
+// Data blocks are compressed concurrently (see WithParallelism).
+// Metadata tables can be buffered in temporary files instead of memory (see
+// WithMetadataSpill). Images can be built incrementally, re-using the data
+// blocks of a previous image (see WithPreviousImage).
 //
-// Note that SquashFS requires directory entries to be sorted, i.e. files and
-// directories need to be added in the correct order.
+// Reader implements reading images created by Writer via the io/fs
+// interfaces.
+//
+// Modification times must be between 1970 and 2106 (the range of SquashFS
+// timestamps), the zero time.Time is stored as 1970-01-01 00:00:00 UTC.
+//
+// Entries can be created in any order: directory entries are sorted when the
+// directory is flushed, and Writer.Flush flushes all directories which were not
+// flushed explicitly. The Writer.Add* methods create entries by path, creating
+// missing parent directories as needed.
 //
 // This package intentionally only implements a subset of SquashFS. Notably,
-// block devices, character devices, FIFOs, sockets and xattrs are not
-// supported.
+// NFS export tables are not supported.
 package squashfs
 
 import (
 	"bytes"
 	"compress/zlib"
+	"crypto/sha256"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
 	"io"
+	"math"
 	"os"
-	"path/filepath"
+	"path"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -45,7 +68,7 @@ const (
 type superblock struct {
 	Magic               uint32
 	Inodes              uint32
-	MkfsTime            int32
+	MkfsTime            uint32
 	BlockSize           uint32
 	Fragments           uint32
 	Compression         uint16
@@ -87,7 +110,7 @@ type inodeHeader struct {
 	Mode        uint16
 	Uid         uint16
 	Gid         uint16
-	Mtime       int32
+	Mtime       uint32
 	InodeNumber uint32
 }
 
@@ -100,13 +123,30 @@ modeRX is:
 */
 const modeRX = 0o555 /* u=rx,g=rx,o=rx */
 
+// unixPerm returns the permission bits of mode, including the setuid, setgid
+// and sticky bits, in their unix representation. Both os.ModeSetuid etc. and
+// the corresponding unix bits (e.g. 0o4755) are accepted.
+func unixPerm(mode os.FileMode) uint16 {
+	perm := uint16(mode & 0o7777)
+	if mode&os.ModeSetuid != 0 {
+		perm |= 0o4000
+	}
+	if mode&os.ModeSetgid != 0 {
+		perm |= 0o2000
+	}
+	if mode&os.ModeSticky != 0 {
+		perm |= 0o1000
+	}
+	return perm
+}
+
 // fileType
 type regInodeHeader struct {
 	inodeHeader
 
 	// full byte offset from the start of the file system, e.g. 96 for first
-	// file contents. Not using fragments limits us to 2^32-1-96 (≈ 4GiB) bytes
-	// of file contents.
+	// file contents. Files starting (or ending) beyond 4 GiB require an
+	// lregInodeHeader.
 	StartBlock uint32
 	Fragment   uint32
 	Offset     uint32
@@ -115,6 +155,21 @@ type regInodeHeader struct {
 	// Followed by a uint32 array of compressed block sizes.
 }
 
+// lregType
+type lregInodeHeader struct {
+	inodeHeader
+
+	StartBlock uint64
+	FileSize   uint64
+	Sparse     uint64
+	Nlink      uint32
+	Fragment   uint32
+	Offset     uint32
+	Xattr      uint32
+
+	// Followed by a uint32 array of compressed block sizes.
+}
+
 // symlinkType
 type symlinkInodeHeader struct {
 	inodeHeader
@@ -179,35 +234,93 @@ type dirEntry struct {
 	// Followed by a byte array of Size bytes.
 }
 
-func writeIdTable(w io.WriteSeeker, ids []uint32) (start int64, err error) {
-	metaOff, err := w.Seek(0, io.SeekCurrent)
-	if err != nil {
-		return 0, err
-	}
-	var buf bytes.Buffer
-	if err := binary.Write(&buf, binary.LittleEndian, ids); err != nil {
-		return 0, err
-	}
+const (
+	dirHeaderSize = 12
+	dirEntrySize  = 8 // without the name
+
+	// maxDirHeaderEntries is the maximum number of entries per directory
+	// header.
+	maxDirHeaderEntries = 256
+)
+
+// dirIndex is an entry of the directory index, which follows an ldir inode.
+type dirIndex struct {
+	Index      uint32 // offset of the directory header within the listing
+	StartBlock uint32 // metadata block containing the header
+	Size       uint32
+
+	// Followed by a byte array of Size bytes: the name of the first entry
+	// of the header.
+}
 
-	if err := binary.Write(w, binary.LittleEndian, uint16(buf.Len())|0x8000); err != nil {
+type dirIndexEntry struct {
+	dirIndex
+	name string
+}
+
+// fragmentEntry is an entry in the fragment table.
+type fragmentEntry struct {
+	Start  int64
+	Size   uint32 // on-disk size, including the uncompressed bit
+	Unused uint32
+}
+
+// writeTable writes a table of fixed-size entries (e.g. the id table or the
+// fragment table) in metadata blocks, followed by header (if non-nil) and a
+// list of uint64 offsets of each metadata block. The returned start offset
+// points to the header or list and is what the superblock refers to.
+func (w *Writer) writeTable(entries, header any) (start int64, err error) {
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, entries); err != nil {
 		return 0, err
 	}
-	if _, err := io.Copy(w, &buf); err != nil {
-		return 0, err
+	var offsets []int64
+	for buf.Len() > 0 {
+		off, err := w.w.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, err
+		}
+		offsets = append(offsets, off)
+		if err := w.writeMetadataBlock(w.w, buf.Next(metadataBlockSize)); err != nil {
+			return 0, err
+		}
 	}
-	off, err := w.Seek(0, io.SeekCurrent)
+	start, err = w.w.Seek(0, io.SeekCurrent)
 	if err != nil {
 		return 0, err
 	}
-	return off, binary.Write(w, binary.LittleEndian, metaOff)
+	if header != nil {
+		if err := binary.Write(w.w, binary.LittleEndian, header); err != nil {
+			return 0, err
+		}
+	}
+	return start, binary.Write(w.w, binary.LittleEndian, offsets)
 }
 
 type fullDirEntry struct {
-	startBlock  uint32
-	offset      uint16
-	inodeNumber uint32
-	entryType   uint16
-	name        string
+	inode *inodeRecord
+	name  string
+}
+
+// inodeRecord tracks an inode which is referenced by one or more directory
+// entries. Except for directories, inodes are written to the inode table when
+// the first directory referring to them is flushed, so that Link can increase
+// the link count until then.
+type inodeRecord struct {
+	number    uint32
+	entryType uint16 // basic inode type, as used in directory entries
+	nlink     uint32
+
+	// write writes the inode to the inode table.
+	write func(nlink uint32) error
+
+	// paths contains the paths under which the inode can be used as a hard
+	// link target.
+	paths []string
+
+	written    bool
+	startBlock uint32
+	offset     uint16
 }
 
 const (
@@ -219,17 +332,100 @@ const (
 )
 
 type Writer struct {
-	// Root represents the file system root. Like all directories, Flush must be
-	// called precisely once.
+	// Root represents the file system root. Writer.Flush flushes Root (and all
+	// directories which were not flushed explicitly).
 	Root *Directory
 
 	w io.WriteSeeker
 
 	sb       superblock
-	inodeBuf bytes.Buffer
-	dirBuf   bytes.Buffer
+	inodeBuf metadataWriter
+	dirBuf   metadataWriter
+
+	// compressMetadata enables compression of metadata blocks, see
+	// WithMetadataCompression.
+	compressMetadata bool
+
+	// spillLimit and spillDir configure buffering metadata tables in
+	// temporary files, see WithMetadataSpill.
+	spillLimit int64
+	spillDir   string
+
+	// fragBuf accumulates the tail ends of files (i.e. the last data block if
+	// it is smaller than dataBlockSize) until dataBlockSize bytes are reached,
+	// at which point a fragment block is written.
+	fragBuf   bytes.Buffer
+	fragments []fragmentEntry
+
+	compressor Compressor
+
+	// dataByHash maps the SHA-256 hash of file contents to the location of the
+	// contents in the image, for de-duplicating identical files.
+	dataByHash map[[sha256.Size]byte]fileData
+	// maxDataSize is the size of the largest file in dataByHash: larger files
+	// cannot be duplicates, so their size can be checked while writing.
+	maxDataSize int64
+
+	// ids is the uid/gid lookup table, idIndexById maps ids to their index.
+	ids         []uint32
+	idIndexById map[uint32]uint16
+
+	// xattrBuf holds the xattr key/value table, xattrIds the xattr id table.
+	xattrBuf        metadataWriter
+	xattrIds        []xattrId
+	xattrIndexByKey map[string]uint32
+
+	// linkTargets maps paths to inodes which have not been written yet, see
+	// Directory.Link.
+	linkTargets map[string]*inodeRecord
+
+	// pendingLinks are hard links created by AddLink, which are resolved in
+	// Flush so that the target can be added after the link.
+	pendingLinks []pendingLink
+
+	// discardedEnd is the end offset of data which was discarded by
+	// de-duplication, which needs to be cleared if it extends past the end of
+	// the image.
+	discardedEnd int64
+
+	// workers limits the number of concurrently compressed data blocks, see
+	// WithParallelism.
+	workers chan struct{}
+
+	// clampTime is the latest modification time, see WithClampTime.
+	clampTime time.Time
+
+	// maxSize is the maximum image size, see WithMaxSize.
+	maxSize int64
+
+	// previous is the previous version of the image, see WithPreviousImage.
+	// Its data area was copied to [previousStart, previousEnd), previousUsed
+	// contains the hashes of its file contents which the new image uses.
+	previous        io.ReaderAt
+	maxUnreferenced float64
+	previousStart   int64
+	previousEnd     int64
+	previousUsed    map[[sha256.Size]byte]bool
+
+	// dataEnd is the end offset of the data written so far, metadataEstimate
+	// the estimated size of the inodes and directory entries, see
+	// SizeEstimate. imageSize is the actual size, once known.
+	dataEnd          int64
+	metadataEstimate int64
+	imageSize        int64
+
+	// fileStats are returned by FileStats, fragmentTails refers to the files
+	// whose ends are stored in the current fragment block.
+	fileStats     []FileStat
+	fragmentTails []fragmentTail
+
+	// compBuf is used for holding a block during compression to avoid memory
+	// allocations.
+	compBuf []byte
 
-	writeInodeNumTo map[string][]int64
+	// err is the first error returned by Directory.Flush, which is returned
+	// by Writer.Flush, too: the image would lack the directory otherwise.
+	err error
 }
 
 // TODO: document what this is doing and what it is used for
@@ -244,7 +440,7 @@ func slog(block uint32) uint16 {
 
 // filesystemFlags returns flags for a SquashFS file system created by this
 // package (disabling most features for now).
-func filesystemFlags() uint16 {
+func (w *Writer) filesystemFlags() uint16 {
 	const (
 		noI = 1 << iota // uncompressed metadata
 		noD             // uncompressed data
@@ -258,7 +454,215 @@ func filesystemFlags() uint16 {
 		noXattr           // no xattrs
 		compopt           // compressor-specific options present?
 	)
-	return noI | noF | noFrag | noX | noXattr
+	flags := uint16(duplicateChecking)
+	if !w.compressMetadata {
+		flags |= noI | noX
+	}
+	if len(w.xattrIds) == 0 {
+		flags |= noXattr
+	}
+	if _, ok := w.compressor.(uncompressed); ok {
+		flags |= noI | noD | noF | noX
+	}
+	if w.compressor.Options() != nil {
+		flags |= compopt
+	}
+	return flags
+}
+
+// An EntryOption sets optional attributes when creating a directory entry,
+// e.g. using Directory.File.
+type EntryOption func(*entryOptions)
+
+type entryOptions struct {
+	uid, gid uint32
+	xattrs   []Xattr
+
+	// err is set by options with invalid arguments.
+	err error
+}
+
+// WithOwner sets the owner of the entry to uid and gid. By default, entries
+// are owned by root (uid 0, gid 0).
+func WithOwner(uid, gid uint32) EntryOption {
+	return func(o *entryOptions) {
+		o.uid = uid
+		o.gid = gid
+	}
+}
+
+// inodeAttrs are the inode attributes which are set using EntryOption.
+type inodeAttrs struct {
+	uid, gid uint16 // id table indices
+	xattr    uint32 // xattr id table index, or invalidXattr
+}
+
+// inodeAttrs applies opts, adding the resulting owner to the id table and the
+// extended attributes to the xattr tables.
+func (w *Writer) inodeAttrs(opts []EntryOption) (inodeAttrs, error) {
+	var o entryOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.err != nil {
+		return inodeAttrs{}, o.err
+	}
+	var (
+		a   inodeAttrs
+		err error
+	)
+	if a.uid, err = w.idIndex(o.uid); err != nil {
+		return inodeAttrs{}, err
+	}
+	if a.gid, err = w.idIndex(o.gid); err != nil {
+		return inodeAttrs{}, err
+	}
+	if a.xattr, err = w.xattrIndex(o.xattrs); err != nil {
+		return inodeAttrs{}, err
+	}
+	return a, nil
+}
+
+// maxIds is the maximum number of id table entries. Inodes reference ids by
+// uint16 index (allowing for 65536 entries), but the superblock stores the
+// number of entries as uint16, too, and Linux rejects images with 0 ids.
+const maxIds = 1<<16 - 1
+
+// idIndex returns the index of id in the id table, adding it if necessary.
+func (w *Writer) idIndex(id uint32) (uint16, error) {
+	if idx, ok := w.idIndexById[id]; ok {
+		return idx, nil
+	}
+	if len(w.ids) == maxIds {
+		return 0, fmt.Errorf("squashfs: too many distinct uids/gids (limit %d)", maxIds)
+	}
+	idx := uint16(len(w.ids))
+	w.ids = append(w.ids, id)
+	w.idIndexById[id] = idx
+	return idx, nil
+}
+
+// Option configures optional Writer behavior, see NewWriter.
+type Option func(*Writer)
+
+// WithMetadataCompression enables compression of the inode table, directory
+// table and id table. By default, metadata is stored uncompressed.
+func WithMetadataCompression() Option {
+	return func(w *Writer) {
+		w.compressMetadata = true
+	}
+}
+
+// WithMetadataSpill bounds the memory used for buffering the inode, directory
+// and xattr tables until Flush: once a table exceeds limit bytes, it is moved
+// to a temporary file in dir (os.TempDir if empty), which Flush removes. By
+// default, all tables are kept in memory.
+//
+// Directory entries and inodes are still kept in memory until their directory
+// is flushed, so for bounded memory usage, flush directories as soon as they
+// are complete (see Directory.Flush). WriteFS does so automatically, as does
+// WriteTar with WithTarFlush. The memory used for de-duplication and
+// FileStats remains proportional to the number of regular files (about 250
+// bytes per file).
+func WithMetadataSpill(limit int64, dir string) Option {
+	return func(w *Writer) {
+		w.spillLimit = limit
+		w.spillDir = dir
+	}
+}
+
+// WithParallelism sets the number of data blocks which are compressed
+// concurrently. By default, runtime.GOMAXPROCS(0) blocks are compressed
+// concurrently. Regardless of the parallelism, blocks are stored in order, so
+// the output does not change.
+func WithParallelism(n int) Option {
+	return func(w *Writer) {
+		w.workers = make(chan struct{}, max(n, 1))
+	}
+}
+
+// WithClampTime clamps all modification times (including the mkfsTime passed
+// to NewWriter) to t: later times are replaced with t. This makes the image
+// independent of when it was built, i.e. creating an image from the same
+// inputs (with the same sequence of calls) results in byte-identical output.
+// See also SourceDateEpoch.
+func WithClampTime(t time.Time) Option {
+	return func(w *Writer) {
+		w.clampTime = t
+	}
+}
+
+// SourceDateEpoch returns the time specified by the SOURCE_DATE_EPOCH
+// environment variable (see https://reproducible-builds.org/specs/source-date-epoch/),
+// for use with WithClampTime. If the variable is not set, ok is false.
+func SourceDateEpoch() (t time.Time, ok bool, err error) {
+	v := os.Getenv("SOURCE_DATE_EPOCH")
+	if v == "" {
+		return time.Time{}, false, nil
+	}
+	sec, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("squashfs: invalid SOURCE_DATE_EPOCH: %v", err)
+	}
+	return time.Unix(sec, 0), true, nil
+}
+
+// mtime returns the on-disk representation of the modification time t,
+// clamped as configured by WithClampTime. SquashFS stores modification times
+// as unsigned 32-bit seconds since the epoch, so t must be between 1970 and
+// 2106. The zero time.Time (e.g. returned by embed.FS) is stored as the epoch.
+func (w *Writer) mtime(t time.Time) (uint32, error) {
+	if t.IsZero() {
+		return 0, nil
+	}
+	if !w.clampTime.IsZero() && t.After(w.clampTime) {
+		t = w.clampTime
+	}
+	sec := t.Unix()
+	if sec < 0 || sec > math.MaxUint32 {
+		return 0, fmt.Errorf("squashfs: modification time %v out of range", t)
+	}
+	return uint32(sec), nil
+}
+
+// maxNameSize is the maximum length of a directory entry name.
+const maxNameSize = 256
+
+// checkName returns an error if name cannot be used as a directory entry
+// name.
+func checkName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\x00") {
+		return fmt.Errorf("squashfs: invalid directory entry name %q", name)
+	}
+	if len(name) > maxNameSize {
+		return fmt.Errorf("squashfs: directory entry name %q too long (limit %d bytes)", name, maxNameSize)
+	}
+	return nil
+}
+
+// maxSymlinkSize is the maximum length of a symbolic link target (PATH_MAX
+// including the terminating NUL byte on Linux).
+const maxSymlinkSize = 4096
+
+// checkSymlinkTarget returns an error if target cannot be used as the target
+// of a symbolic link.
+func checkSymlinkTarget(target string) error {
+	if target == "" || strings.Contains(target, "\x00") {
+		return fmt.Errorf("squashfs: invalid symbolic link target %q", target)
+	}
+	if len(target) > maxSymlinkSize {
+		return fmt.Errorf("squashfs: symbolic link target too long (%d bytes, limit %d bytes)", len(target), maxSymlinkSize)
+	}
+	return nil
+}
+
+// WithCompressor sets the Compressor for data and metadata blocks. By default,
+// zlib at zlib.BestSpeed is used. NewWriter returns an error if c was created
+// with invalid parameters, e.g. Zlib(0).
+func WithCompressor(c Compressor) Option {
+	return func(w *Writer) {
+		w.compressor = c
+	}
 }
 
 // NewWriter returns a Writer which will write a SquashFS file system image to w
@@ -268,7 +672,7 @@ func filesystemFlags() uint16 {
 // directory of the Writer.
 //
 // File data is written to w even before Flush is called.
-func NewWriter(w io.WriteSeeker, mkfsTime time.Time) (*Writer, error) {
+func NewWriter(w io.WriteSeeker, mkfsTime time.Time, opts ...Option) (*Writer, error) {
 	// Skip over superblock to the data area, we come back to the superblock
 	// when flushing.
 	if _, err := w.Seek(96, io.SeekStart); err != nil {
@@ -276,54 +680,175 @@ func NewWriter(w io.WriteSeeker, mkfsTime time.Time) (*Writer, error) {
 	}
 	wr := &Writer{
 		w: w,
+		// zlib.BestSpeed results in only a 2x slow-down over no compression
+		// (compared to >4x slow-down with DefaultCompression), but generates
+		// results which are in the same ball park (10% larger).
+		compressor:  Zlib(zlib.BestSpeed),
+		compBuf:     make([]byte, 0, dataBlockSize),
+		dataByHash:  make(map[[sha256.Size]byte]fileData),
+		linkTargets: make(map[string]*inodeRecord),
+
+		idIndexById:     make(map[uint32]uint16),
+		xattrIndexByKey: make(map[string]uint32),
 		sb: superblock{
 			Magic:             magic,
-			MkfsTime:          int32(mkfsTime.Unix()),
 			BlockSize:         dataBlockSize,
 			Fragments:         0,
-			Compression:       zlibCompression,
 			BlockLog:          slog(dataBlockSize),
-			Flags:             filesystemFlags(),
-			NoIds:             1, // just one uid/gid mapping (for root)
 			Major:             majorVersion,
 			Minor:             minorVersion,
 			XattrIdTableStart: -1, // not present
 			LookupTableStart:  -1, // not present
 		},
-		writeInodeNumTo: make(map[string][]int64),
+	}
+	for _, opt := range opts {
+		opt(wr)
+	}
+	for _, mw := range wr.metadataWriters() {
+		mw.w = wr
+		mw.out.limit = wr.spillLimit
+		mw.out.dir = wr.spillDir
+	}
+	if wr.compressor == nil {
+		return nil, errors.New("squashfs: nil Compressor")
+	}
+	if v, ok := wr.compressor.(validator); ok {
+		if err := v.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if wr.workers == nil {
+		wr.workers = make(chan struct{}, runtime.GOMAXPROCS(0))
+	}
+	var err error
+	if wr.sb.MkfsTime, err = wr.mtime(mkfsTime); err != nil {
+		return nil, err
+	}
+	wr.sb.Compression = wr.compressor.ID()
+	wr.dataEnd = 96
+	// (2) compressor-specific options are stored in an uncompressed metadata
+	// block directly following the superblock.
+	if opts := wr.compressor.Options(); opts != nil {
+		if err := binary.Write(w, binary.LittleEndian, uint16(len(opts))|0x8000); err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(opts); err != nil {
+			return nil, err
+		}
+		wr.dataEnd += 2 + int64(len(opts))
+	}
+	if wr.previous != nil {
+		if err := wr.reusePrevious(); err != nil {
+			return nil, err
+		}
+	}
+	wr.estimateEntry("", ldirInodeSizeEstimate)
+	rootAttrs, err := wr.inodeAttrs(nil)
+	if err != nil {
+		return nil, err
 	}
 	wr.Root = &Directory{
-		w:       wr,
-		name:    "", // root
-		modTime: mkfsTime,
+		w:           wr,
+		name:        "", // root
+		modTime:     mkfsTime,
+		mode:        modeRX,
+		inodeNumber: wr.allocateInode(),
+		attrs:       rootAttrs,
+		implicit:    true,
 	}
 	return wr, nil
 }
 
+// metadataWriters returns the metadata tables which are buffered until Flush.
+func (w *Writer) metadataWriters() []*metadataWriter {
+	return []*metadataWriter{&w.inodeBuf, &w.dirBuf, &w.xattrBuf}
+}
+
+// allocateInode returns the next unused inode number.
+func (w *Writer) allocateInode() uint32 {
+	w.sb.Inodes++
+	return w.sb.Inodes
+}
+
+// writeInode writes rec to the inode table, unless it was already written.
+func (w *Writer) writeInode(rec *inodeRecord) error {
+	if rec.written {
+		return nil
+	}
+	rec.startBlock, rec.offset = w.inodeBuf.ref()
+	if err := rec.write(rec.nlink); err != nil {
+		return err
+	}
+	rec.written = true
+	rec.write = nil // release everything the closure refers to
+	for _, p := range rec.paths {
+		delete(w.linkTargets, p)
+	}
+	rec.paths = nil
+	return nil
+}
+
+// addInode adds a directory entry for rec to d, registering it as a hard link
+// target. inodeSize is the estimated size of the inode (0 for hard links to
+// an existing inode), see SizeEstimate.
+func (d *Directory) addInode(name string, rec *inodeRecord, inodeSize int) error {
+	d.dirEntries = append(d.dirEntries, fullDirEntry{
+		inode: rec,
+		name:  name,
+	})
+	p := d.path(name)
+	rec.paths = append(rec.paths, p)
+	d.w.linkTargets[p] = rec
+	d.w.estimateEntry(name, inodeSize)
+	return d.w.checkSize("/" + p)
+}
+
+// path returns the slash-separated path of name within d, relative to the
+// file system root.
+func (d *Directory) path(name string) string {
+	if d.parent == nil {
+		return name
+	}
+	return d.parent.path(d.name) + "/" + name
+}
+
 // Directory represents a SquashFS directory.
 type Directory struct {
 	w          *Writer
 	name       string
 	modTime    time.Time
+	mode       os.FileMode
 	dirEntries []fullDirEntry
 	parent     *Directory
-}
 
-func (d *Directory) path() string {
-	if d.parent == nil {
-		return d.name
-	}
-	return filepath.Join(d.parent.path(), d.name)
+	// inodeNumber is allocated when creating the directory so that
+	// subdirectories can refer to it as their parent inode.
+	inodeNumber uint32
+
+	attrs inodeAttrs
+
+	// subdirs contains all directories created in this directory, which are
+	// flushed (if they were not flushed explicitly) before this directory.
+	subdirs      []*Directory
+	subdirByName map[string]*Directory
+
+	// implicit is true for directories which were created as parents by the
+	// Writer.Add* methods, whose attributes can still be set using
+	// Writer.AddDirectory.
+	implicit bool
+
+	flushed bool
 }
 
 type file struct {
-	w       *Writer
-	d       *Directory
-	off     int64
-	size    uint32
-	name    string
-	modTime time.Time
-	mode    os.FileMode
+	w     *Writer
+	d     *Directory
+	off   int64
+	size  int64
+	name  string
+	mtime uint32
+	mode  os.FileMode
+	attrs inodeAttrs
 
 	// buf accumulates at least dataBlockSize bytes, at which point a new block
 	// is being written.
@@ -333,208 +858,522 @@ type file struct {
 	// the number of bytes the block compressed down to.
 	blocksizes []uint32
 
-	// compBuf is used for holding a block during compression to avoid memory
-	// allocations.
-	compBuf *bytes.Buffer
-	// zlibWriter is re-used for each compressed block
-	zlibWriter *zlib.Writer
+	// pending contains blocks which are being compressed, oldest first.
+	pending []*blockJob
+
+	// sparse is the number of bytes in all-zero blocks which are stored as
+	// holes.
+	sparse int64
+
+	// stat is the index of the file in Writer.fileStats, set by Close.
+	stat int
+
+	// hash is the SHA-256 hash of the file contents written so far.
+	hash hash.Hash
 }
 
-// Directory creates a new directory with the specified name and modTime.
-func (d *Directory) Directory(name string, modTime time.Time) *Directory {
-	return &Directory{
-		w:       d.w,
-		name:    name,
-		modTime: modTime,
-		parent:  d,
+// fileData describes where the contents of a regular file are stored.
+type fileData struct {
+	startBlock int64
+	blocksizes []uint32
+	fragment   uint32
+	fragOffset uint32
+	sparse     int64 // number of bytes in holes
+
+	// previous is true for data of the previous image, see WithPreviousImage.
+	previous bool
+}
+
+// checkFlushed returns an error if d was already flushed, in which case no
+// more entries can be added.
+func (d *Directory) checkFlushed() error {
+	if d.flushed {
+		return fmt.Errorf("squashfs: directory %q already flushed", d.fullPath())
+	}
+	return nil
+}
+
+// checkEntry returns an error if an entry with the specified name and
+// modification time cannot be added to d, and the on-disk modification time
+// otherwise.
+func (d *Directory) checkEntry(name string, modTime time.Time) (uint32, error) {
+	if err := d.checkFlushed(); err != nil {
+		return 0, err
+	}
+	if err := checkName(name); err != nil {
+		return 0, err
+	}
+	return d.w.mtime(modTime)
+}
+
+// Directory creates a new directory with the specified name, modTime and mode
+// (e.g. 0o755 or 0o700; the type bits are ignored).
+func (d *Directory) Directory(name string, modTime time.Time, mode os.FileMode, opts ...EntryOption) (*Directory, error) {
+	if _, err := d.checkEntry(name, modTime); err != nil {
+		return nil, err
 	}
+	attrs, err := d.w.inodeAttrs(opts)
+	if err != nil {
+		return nil, err
+	}
+	sub := &Directory{
+		w:           d.w,
+		name:        name,
+		modTime:     modTime,
+		mode:        mode,
+		parent:      d,
+		inodeNumber: d.w.allocateInode(),
+		attrs:       attrs,
+	}
+	d.subdirs = append(d.subdirs, sub)
+	if d.subdirByName == nil {
+		d.subdirByName = make(map[string]*Directory)
+	}
+	d.subdirByName[name] = sub
+	d.w.estimateEntry(name, ldirInodeSizeEstimate)
+	return sub, nil
 }
 
 // File creates a file with the specified name, modTime and mode. The returned
 // io.WriterCloser must be closed after writing the file.
-func (d *Directory) File(name string, modTime time.Time, mode os.FileMode) (io.WriteCloser, error) {
-	off, err := d.w.w.Seek(0, io.SeekCurrent)
+func (d *Directory) File(name string, modTime time.Time, mode os.FileMode, opts ...EntryOption) (io.WriteCloser, error) {
+	mtime, err := d.checkEntry(name, modTime)
+	if err != nil {
+		return nil, err
+	}
+	attrs, err := d.w.inodeAttrs(opts)
 	if err != nil {
 		return nil, err
 	}
 
-	// zlib.BestSpeed results in only a 2x slow-down over no compression
-	// (compared to >4x slow-down with DefaultCompression), but generates
-	// results which are in the same ball park (10% larger).
-	zw, err := zlib.NewWriterLevel(nil, zlib.BestSpeed)
+	off, err := d.w.w.Seek(0, io.SeekCurrent)
 	if err != nil {
 		return nil, err
 	}
+
 	return &file{
-		w:          d.w,
-		d:          d,
-		off:        off,
-		name:       name,
-		modTime:    modTime,
-		mode:       mode,
-		compBuf:    bytes.NewBuffer(make([]byte, dataBlockSize)),
-		zlibWriter: zw,
+		w:     d.w,
+		d:     d,
+		off:   off,
+		name:  name,
+		mtime: mtime,
+		mode:  mode,
+		attrs: attrs,
+		hash:  sha256.New(),
 	}, nil
 }
 
 // Symlink creates a symbolic link from newname to oldname with the specified
-// modTime and mode.
-func (d *Directory) Symlink(oldname, newname string, modTime time.Time, mode os.FileMode) error {
-	startBlock := d.w.inodeBuf.Len() / metadataBlockSize
-	offset := d.w.inodeBuf.Len() - startBlock*metadataBlockSize
-
-	if err := binary.Write(&d.w.inodeBuf, binary.LittleEndian, symlinkInodeHeader{
-		inodeHeader: inodeHeader{
-			InodeType:   symlinkType,
-			Mode:        uint16(mode),
-			Uid:         0,
-			Gid:         0,
-			Mtime:       int32(modTime.Unix()),
-			InodeNumber: d.w.sb.Inodes + 1,
+// modTime and mode. oldname must not be empty and must not exceed 4096 bytes.
+func (d *Directory) Symlink(oldname, newname string, modTime time.Time, mode os.FileMode, opts ...EntryOption) error {
+	mtime, err := d.checkEntry(newname, modTime)
+	if err != nil {
+		return err
+	}
+	if err := checkSymlinkTarget(oldname); err != nil {
+		return err
+	}
+	attrs, err := d.w.inodeAttrs(opts)
+	if err != nil {
+		return err
+	}
+	inodeNumber := d.w.allocateInode()
+	return d.addInode(newname, &inodeRecord{
+		number:    inodeNumber,
+		entryType: symlinkType,
+		nlink:     1,
+		write: func(nlink uint32) error {
+			hdr := symlinkInodeHeader{
+				inodeHeader: inodeHeader{
+					InodeType:   symlinkType,
+					Mode:        unixPerm(mode),
+					Uid:         attrs.uid,
+					Gid:         attrs.gid,
+					Mtime:       mtime,
+					InodeNumber: inodeNumber,
+				},
+				Nlink:       nlink,
+				SymlinkSize: uint32(len(oldname)),
+			}
+			if attrs.xattr != invalidXattr {
+				hdr.InodeType = lsymlinkType
+			}
+			if err := binary.Write(&d.w.inodeBuf, binary.LittleEndian, hdr); err != nil {
+				return err
+			}
+			if _, err := d.w.inodeBuf.Write([]byte(oldname)); err != nil {
+				return err
+			}
+			if attrs.xattr != invalidXattr {
+				return binary.Write(&d.w.inodeBuf, binary.LittleEndian, attrs.xattr)
+			}
+			return nil
 		},
-		Nlink:       1, // TODO(later): when is this not 1?
-		SymlinkSize: uint32(len(oldname)),
-	}); err != nil {
+	}, symlinkSizeEstimate+len(oldname))
+}
+
+// Device creates a device node with the specified name, device number, modTime
+// and mode. If mode contains os.ModeCharDevice, a character device is created,
+// otherwise a block device.
+func (d *Directory) Device(name string, major, minor uint32, modTime time.Time, mode os.FileMode, opts ...EntryOption) error {
+	mtime, err := d.checkEntry(name, modTime)
+	if err != nil {
 		return err
 	}
-	if _, err := d.w.inodeBuf.Write([]byte(oldname)); err != nil {
+	if major > maxMajor || minor > maxMinor {
+		return fmt.Errorf("squashfs: device number %d:%d out of range", major, minor)
+	}
+	typ := uint16(blkdevType)
+	if mode&os.ModeCharDevice != 0 {
+		typ = chrdevType
+	}
+	attrs, err := d.w.inodeAttrs(opts)
+	if err != nil {
 		return err
 	}
+	inodeNumber := d.w.allocateInode()
+	return d.addInode(name, &inodeRecord{
+		number:    inodeNumber,
+		entryType: typ,
+		nlink:     1,
+		write: func(nlink uint32) error {
+			hdr := devInodeHeader{
+				inodeHeader: inodeHeader{
+					InodeType:   typ,
+					Mode:        unixPerm(mode),
+					Uid:         attrs.uid,
+					Gid:         attrs.gid,
+					Mtime:       mtime,
+					InodeNumber: inodeNumber,
+				},
+				Nlink: nlink,
+				Rdev:  encodeDev(major, minor),
+			}
+			return d.w.writeIPCOrDevInode(&hdr.inodeHeader, &hdr, attrs.xattr)
+		},
+	}, devInodeSizeEstimate)
+}
 
-	d.dirEntries = append(d.dirEntries, fullDirEntry{
-		startBlock:  uint32(startBlock),
-		offset:      uint16(offset),
-		inodeNumber: d.w.sb.Inodes + 1,
-		entryType:   symlinkType,
-		name:        newname,
-	})
+// maxMajor and maxMinor are the largest device numbers which encodeDev can
+// represent.
+const (
+	maxMajor = 1<<12 - 1
+	maxMinor = 1<<20 - 1
+)
 
-	d.w.sb.Inodes++
-	return nil
+// encodeDev encodes a device number like Linux (new_encode_dev).
+func encodeDev(major, minor uint32) uint32 {
+	return (minor & 0xff) | (major << 8) | ((minor &^ 0xff) << 12)
+}
+
+// decodeDev is the inverse of encodeDev.
+func decodeDev(dev uint32) (major, minor uint32) {
+	return (dev & 0xfff00) >> 8, (dev & 0xff) | ((dev >> 12) & 0xfff00)
+}
+
+// Fifo creates a named pipe with the specified name, modTime and mode.
+func (d *Directory) Fifo(name string, modTime time.Time, mode os.FileMode, opts ...EntryOption) error {
+	return d.ipc(name, fifoType, modTime, mode, opts)
+}
+
+// Socket creates a unix domain socket with the specified name, modTime and
+// mode.
+func (d *Directory) Socket(name string, modTime time.Time, mode os.FileMode, opts ...EntryOption) error {
+	return d.ipc(name, socketType, modTime, mode, opts)
 }
 
-// Flush writes directory entries and creates inodes for the directory.
+// ipc adds an inode of type fifoType or socketType.
+func (d *Directory) ipc(name string, typ uint16, modTime time.Time, mode os.FileMode, opts []EntryOption) error {
+	mtime, err := d.checkEntry(name, modTime)
+	if err != nil {
+		return err
+	}
+	attrs, err := d.w.inodeAttrs(opts)
+	if err != nil {
+		return err
+	}
+	inodeNumber := d.w.allocateInode()
+	return d.addInode(name, &inodeRecord{
+		number:    inodeNumber,
+		entryType: typ,
+		nlink:     1,
+		write: func(nlink uint32) error {
+			hdr := ipcInodeHeader{
+				inodeHeader: inodeHeader{
+					InodeType:   typ,
+					Mode:        unixPerm(mode),
+					Uid:         attrs.uid,
+					Gid:         attrs.gid,
+					Mtime:       mtime,
+					InodeNumber: inodeNumber,
+				},
+				Nlink: nlink,
+			}
+			return d.w.writeIPCOrDevInode(&hdr.inodeHeader, &hdr, attrs.xattr)
+		},
+	}, ipcInodeSizeEstimate)
+}
+
+// writeIPCOrDevInode writes hdr (a *ipcInodeHeader or *devInodeHeader, whose
+// embedded inodeHeader is ih) to the inode table. If xattr is valid, the
+// extended inode type is used, which is followed by the xattr index.
+func (w *Writer) writeIPCOrDevInode(ih *inodeHeader, hdr any, xattr uint32) error {
+	if xattr == invalidXattr {
+		return binary.Write(&w.inodeBuf, binary.LittleEndian, hdr)
+	}
+	ih.InodeType += ldirType - dirType
+	if err := binary.Write(&w.inodeBuf, binary.LittleEndian, hdr); err != nil {
+		return err
+	}
+	return binary.Write(&w.inodeBuf, binary.LittleEndian, xattr)
+}
+
+// Link creates a hard link with the specified name, referring to the existing
+// non-directory target, a slash-separated path relative to the file system
+// root (e.g. "bin/busybox"). Both share a single inode, so the directory
+// containing target must not have been flushed yet.
+func (d *Directory) Link(name, target string) error {
+	if err := d.checkFlushed(); err != nil {
+		return err
+	}
+	if err := checkName(name); err != nil {
+		return err
+	}
+	rec, ok := d.w.linkTargets[strings.TrimPrefix(path.Clean("/"+target), "/")]
+	if !ok {
+		return fmt.Errorf("squashfs: hard link target %q not found (or its directory was already flushed)", target)
+	}
+	rec.nlink++
+	return d.addInode(name, rec, 0)
+}
+
+// dirHeaderRun returns the number of entries (at the start of entries) which
+// can be covered by a directory header written at position pos of the
+// directory table (in uncompressed bytes): all entries must have their inodes
+// stored in the same metadata block, there must be at most 256 entries, and
+// the difference of each inode number to the inode number of the first entry
+// must fit into an int16. Additionally, a new header is started for the first
+// entry in each metadata block of the directory table, so that the directory
+// index can refer to it.
+func dirHeaderRun(entries []fullDirEntry, pos int64) int {
+	first := entries[0].inode
+	block := pos / metadataBlockSize
+	pos += dirHeaderSize
+	for n, de := range entries {
+		delta := int64(de.inode.number) - int64(first.number)
+		if n > 0 &&
+			(n == maxDirHeaderEntries ||
+				de.inode.startBlock != first.startBlock ||
+				delta < math.MinInt16 || delta > math.MaxInt16 ||
+				pos/metadataBlockSize != block) {
+			return n
+		}
+		pos += dirEntrySize + int64(len(de.name))
+	}
+	return len(entries)
+}
+
+// Flush writes directory entries and creates inodes for the directory. Any
+// subdirectories which were not flushed yet are flushed first. The directory
+// must not be modified after calling Flush, and it must be flushed before its
+// parent directory.
+//
+// If Flush fails, Writer.Flush fails, too.
 func (d *Directory) Flush() error {
-	countByStartBlock := make(map[uint32]uint32)
-	for _, de := range d.dirEntries {
-		countByStartBlock[de.startBlock]++
+	if err := d.checkFlushed(); err != nil {
+		return err
+	}
+	if d.parent != nil && d.parent.flushed {
+		err := fmt.Errorf("squashfs: directory %q flushed after its parent directory", d.fullPath())
+		if d.w.err == nil {
+			d.w.err = err
+		}
+		return err
+	}
+	if err := d.flush(); err != nil {
+		if d.w.err == nil {
+			d.w.err = err
+		}
+		return err
 	}
+	return nil
+}
 
-	dirBufStartBlock := d.w.dirBuf.Len() / metadataBlockSize
-	dirBufOffset := d.w.dirBuf.Len()
+func (d *Directory) flush() error {
+	for _, sub := range d.subdirs {
+		if sub.flushed {
+			continue
+		}
+		if err := sub.Flush(); err != nil {
+			return err
+		}
+	}
+	d.flushed = true
 
-	currentBlock := int64(-1)
-	currentInodeOffset := int64(-1)
-	var subdirs int
-	for _, de := range d.dirEntries {
-		if de.entryType == dirType {
-			subdirs++
-		}
-		if int64(de.startBlock) != currentBlock {
-			dh := dirHeader{
-				Count:       countByStartBlock[de.startBlock] - 1,
-				StartBlock:  de.startBlock * (metadataBlockSize + 2),
-				InodeOffset: de.inodeNumber,
-			}
-			if err := binary.Write(&d.w.dirBuf, binary.LittleEndian, &dh); err != nil {
-				return err
-			}
+	attrs := d.attrs
+	mtime, err := d.w.mtime(d.modTime)
+	if err != nil {
+		return err
+	}
 
-			currentBlock = int64(de.startBlock)
-			currentInodeOffset = int64(de.inodeNumber)
+	// SquashFS requires directory entries to be sorted by name, as the
+	// kernel does a binary search on the directory index.
+	sort.SliceStable(d.dirEntries, func(i, j int) bool {
+		return d.dirEntries[i].name < d.dirEntries[j].name
+	})
+	for i := 1; i < len(d.dirEntries); i++ {
+		if d.dirEntries[i].name == d.dirEntries[i-1].name {
+			return fmt.Errorf("squashfs: duplicate directory entry %q", "/"+d.path(d.dirEntries[i].name))
 		}
-		if err := binary.Write(&d.w.dirBuf, binary.LittleEndian, &dirEntry{
-			Offset:      de.offset,
-			InodeNumber: int16(de.inodeNumber - uint32(currentInodeOffset)),
-			EntryType:   de.entryType,
-			Size:        uint16(len(de.name) - 1),
-		}); err != nil {
+	}
+
+	for _, de := range d.dirEntries {
+		if err := d.w.writeInode(de.inode); err != nil {
 			return err
 		}
-		if _, err := d.w.dirBuf.Write([]byte(de.name)); err != nil {
+	}
+
+	dirBufStartBlock, dirBufOffset := d.w.dirBuf.ref()
+	dirBufSize := d.w.dirBuf.size
+
+	var (
+		subdirs int
+		index   []dirIndexEntry
+		// headerBlock is the metadata block (in uncompressed terms) in which
+		// the last directory header was written.
+		headerBlock = int64(-1)
+	)
+	for idx := 0; idx < len(d.dirEntries); {
+		pos := d.w.dirBuf.size
+		run := d.dirEntries[idx : idx+dirHeaderRun(d.dirEntries[idx:], pos)]
+		first := run[0]
+		if block := pos / metadataBlockSize; block != headerBlock {
+			if headerBlock != -1 {
+				// The directory index allows lookups to skip to the first
+				// header in each metadata block of the listing.
+				startBlock, _ := d.w.dirBuf.ref()
+				index = append(index, dirIndexEntry{
+					dirIndex: dirIndex{
+						Index:      uint32(pos - dirBufSize),
+						StartBlock: startBlock,
+						Size:       uint32(len(first.name) - 1),
+					},
+					name: first.name,
+				})
+			}
+			headerBlock = block
+		}
+		dh := dirHeader{
+			Count:       uint32(len(run) - 1),
+			StartBlock:  first.inode.startBlock,
+			InodeOffset: first.inode.number,
+		}
+		if err := binary.Write(&d.w.dirBuf, binary.LittleEndian, &dh); err != nil {
 			return err
 		}
+		for _, de := range run {
+			if de.inode.entryType == dirType {
+				subdirs++
+			}
+			if err := binary.Write(&d.w.dirBuf, binary.LittleEndian, &dirEntry{
+				Offset:      de.inode.offset,
+				InodeNumber: int16(int64(de.inode.number) - int64(first.inode.number)),
+				EntryType:   de.inode.entryType,
+				Size:        uint16(len(de.name) - 1),
+			}); err != nil {
+				return err
+			}
+			if _, err := d.w.dirBuf.Write([]byte(de.name)); err != nil {
+				return err
+			}
+		}
+		idx += len(run)
 	}
+	listingSize := d.w.dirBuf.size - dirBufSize
 
-	startBlock := d.w.inodeBuf.Len() / metadataBlockSize
-	offset := d.w.inodeBuf.Len() - startBlock*metadataBlockSize
-	inodeBufOffset := d.w.inodeBuf.Len()
+	startBlock, offset := d.w.inodeBuf.ref()
 
-	// parentInodeOffset is the offset (in bytes) of the ParentInode field
-	// within a dirInodeHeader or ldirInodeHeader
-	var parentInodeOffset int64
+	// The root directory has no parent, use an inode number past the last
+	// inode like mksquashfs(1) does.
+	parentInode := d.w.sb.Inodes + 1
+	if d.parent != nil {
+		parentInode = d.parent.inodeNumber
+	}
 
+	if len(index) > math.MaxUint16 {
+		return fmt.Errorf("squashfs: directory %q too large", d.fullPath())
+	}
 	if len(d.dirEntries) > 256 ||
-		d.w.dirBuf.Len()-dirBufOffset > metadataBlockSize {
-		parentInodeOffset = (2 + 2 + 2 + 2 + 4 + 4) + 4 + 4 + 4
+		listingSize > metadataBlockSize ||
+		len(index) > 0 ||
+		attrs.xattr != invalidXattr {
 		if err := binary.Write(&d.w.inodeBuf, binary.LittleEndian, ldirInodeHeader{
 			inodeHeader: inodeHeader{
 				InodeType:   ldirType,
-				Mode:        modeRX,
-				Uid:         0,
-				Gid:         0,
-				Mtime:       int32(d.modTime.Unix()),
-				InodeNumber: d.w.sb.Inodes + 1,
+				Mode:        unixPerm(d.mode),
+				Uid:         attrs.uid,
+				Gid:         attrs.gid,
+				Mtime:       mtime,
+				InodeNumber: d.inodeNumber,
 			},
 
-			Nlink:       uint32(subdirs + 2 - 1), // + 2 for . and ..
-			FileSize:    uint32(d.w.dirBuf.Len()-dirBufOffset) + 3,
-			StartBlock:  uint32(dirBufStartBlock * (metadataBlockSize + 2)),
-			ParentInode: d.w.sb.Inodes + 2, // invalid
-			Icount:      0,                 // no directory index
-			Offset:      uint16(dirBufOffset - dirBufStartBlock*metadataBlockSize),
-			Xattr:       invalidXattr,
+			Nlink:       uint32(subdirs + 2), // + 2 for . and ..
+			FileSize:    uint32(listingSize) + 3,
+			StartBlock:  dirBufStartBlock,
+			ParentInode: parentInode,
+			Icount:      uint16(len(index)),
+			Offset:      dirBufOffset,
+			Xattr:       attrs.xattr,
 		}); err != nil {
 			return err
 		}
+		for _, ie := range index {
+			if err := binary.Write(&d.w.inodeBuf, binary.LittleEndian, &ie.dirIndex); err != nil {
+				return err
+			}
+			if _, err := d.w.inodeBuf.Write([]byte(ie.name)); err != nil {
+				return err
+			}
+		}
 	} else {
-		parentInodeOffset = (2 + 2 + 2 + 2 + 4 + 4) + 4 + 4 + 2 + 2
 		if err := binary.Write(&d.w.inodeBuf, binary.LittleEndian, dirInodeHeader{
 			inodeHeader: inodeHeader{
 				InodeType:   dirType,
-				Mode:        modeRX,
-				Uid:         0,
-				Gid:         0,
-				Mtime:       int32(d.modTime.Unix()),
-				InodeNumber: d.w.sb.Inodes + 1,
+				Mode:        unixPerm(d.mode),
+				Uid:         attrs.uid,
+				Gid:         attrs.gid,
+				Mtime:       mtime,
+				InodeNumber: d.inodeNumber,
 			},
-			StartBlock:  uint32(dirBufStartBlock * (metadataBlockSize + 2)),
-			Nlink:       uint32(subdirs + 2 - 1), // + 2 for . and ..
-			FileSize:    uint16(d.w.dirBuf.Len()-dirBufOffset) + 3,
-			Offset:      uint16(dirBufOffset - dirBufStartBlock*metadataBlockSize),
-			ParentInode: d.w.sb.Inodes + 2, // invalid
+			StartBlock:  dirBufStartBlock,
+			Nlink:       uint32(subdirs + 2), // + 2 for . and ..
+			FileSize:    uint16(listingSize) + 3,
+			Offset:      dirBufOffset,
+			ParentInode: parentInode,
 		}); err != nil {
 			return err
 		}
 	}
 
-	path := d.path()
-	for _, offset := range d.w.writeInodeNumTo[path] {
-		// Directly manipulating unread data in bytes.Buffer via Bytes(), as per
-		// https://groups.google.com/d/msg/golang-nuts/1ON9XVQ1jXE/8j9RaeSYxuEJ
-		b := d.w.inodeBuf.Bytes()
-		binary.LittleEndian.PutUint32(b[offset:offset+4], d.w.sb.Inodes+1)
-	}
-
 	if d.parent != nil {
-		parentPath := filepath.Dir(d.path())
-		if parentPath == "." {
-			parentPath = ""
-		}
-		d.w.writeInodeNumTo[parentPath] = append(d.w.writeInodeNumTo[parentPath], int64(inodeBufOffset)+parentInodeOffset)
 		d.parent.dirEntries = append(d.parent.dirEntries, fullDirEntry{
-			startBlock:  uint32(startBlock),
-			offset:      uint16(offset),
-			inodeNumber: d.w.sb.Inodes + 1,
-			entryType:   dirType,
-			name:        d.name,
+			inode: &inodeRecord{
+				number:     d.inodeNumber,
+				entryType:  dirType,
+				written:    true,
+				startBlock: startBlock,
+				offset:     offset,
+			},
+			name: d.name,
 		})
 	} else { // root
-		d.w.sb.RootInode = inode((startBlock*(metadataBlockSize+2))<<16 | offset)
+		d.w.sb.RootInode = inode(int64(startBlock)<<16 | int64(offset))
 	}
 
-	d.w.sb.Inodes++
-
+	// Release the entries (and subdirectories), which were written.
+	d.dirEntries = nil
+	d.subdirs = nil
+	d.subdirByName = nil
 	return nil
 }
 
@@ -542,8 +1381,9 @@ func (d *Directory) Flush() error {
 func (f *file) Write(p []byte) (n int, err error) {
 	n, err = f.buf.Write(p)
 	if n > 0 {
+		f.hash.Write(p[:n])
 		// Keep track of the uncompressed file size.
-		f.size += uint32(n)
+		f.size += int64(n)
 		for f.buf.Len() >= dataBlockSize {
 			if err := f.writeBlock(); err != nil {
 				return 0, err
@@ -553,125 +1393,386 @@ func (f *file) Write(p []byte) (n int, err error) {
 	return n, err
 }
 
+// blockJob is a data block which is compressed by a worker goroutine.
+type blockJob struct {
+	block      []byte
+	compressed []byte
+	err        error
+	done       chan struct{}
+
+	// sparse is true for all-zero blocks, which are not compressed.
+	sparse bool
+}
+
+// zeroBlock is used for detecting all-zero (sparse) blocks.
+var zeroBlock [dataBlockSize]byte
+
+// writeBlock hands the next dataBlockSize bytes of f.buf to a worker for
+// compression. Compressed blocks are written in order by writePending.
 func (f *file) writeBlock() error {
 	n := f.buf.Len()
 	if n > dataBlockSize {
 		n = dataBlockSize
 	}
-	// Feed dataBlockSize bytes to the compressor
 	b := f.buf.Bytes()
-	block := b[:n]
 	rest := b[n:]
+	job := &blockJob{
+		done: make(chan struct{}),
+	}
+	if bytes.Equal(b[:n], zeroBlock[:n]) {
+		// Store all-zero blocks as holes, which take no space.
+		job.sparse = true
+		job.block = b[:0:0]
+		close(job.done)
+	} else {
+		job.block = bytes.Clone(b[:n])
+		go func() {
+			defer close(job.done)
+			f.w.workers <- struct{}{}
+			defer func() { <-f.w.workers }()
+			job.compressed, job.err = f.w.compressor.Compress(nil, job.block)
+		}()
+	}
+	f.pending = append(f.pending, job)
 
-	f.compBuf.Reset()
-	f.zlibWriter.Reset(f.compBuf)
-	if _, err := f.zlibWriter.Write(block); err != nil {
-		return err
+	// Keep the rest in f.buf for the next write
+	copy(b, rest)
+	f.buf.Truncate(len(rest))
+
+	// Limit the number of blocks held in memory to keep workers busy while
+	// the oldest block is written.
+	for len(f.pending) > 2*cap(f.w.workers) {
+		if err := f.writeOldestPending(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeOldestPending waits for the oldest pending block to be compressed and
+// writes it to the underlying writer.
+func (f *file) writeOldestPending() error {
+	job := f.pending[0]
+	f.pending = f.pending[1:]
+	<-job.done
+	if job.err != nil {
+		return job.err
+	}
+	if job.sparse {
+		f.blocksizes = append(f.blocksizes, 0) // size 0 denotes a hole
+		f.sparse += dataBlockSize
+		return nil
 	}
-	if err := f.zlibWriter.Close(); err != nil {
+	size, err := f.w.writeCompressedBlock(job.block, job.compressed)
+	if err != nil {
 		return err
 	}
+	f.blocksizes = append(f.blocksizes, size)
+	// Blocks of duplicate contents are discarded in Close, so only check the
+	// size once the file is larger than any file it could duplicate.
+	if f.size > f.w.maxDataSize {
+		return f.w.checkSize("/" + f.d.path(f.name))
+	}
+	return nil
+}
+
+// writePending writes all pending blocks, in the order they were queued.
+func (f *file) writePending() error {
+	for len(f.pending) > 0 {
+		if err := f.writeOldestPending(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	size := f.compBuf.Len()
-	if size > len(block) {
+// writeDataBlock compresses block and writes it to the underlying writer,
+// returning its on-disk size (including the uncompressed bit, if set).
+func (w *Writer) writeDataBlock(block []byte) (uint32, error) {
+	compressed, err := w.compress(block)
+	if err != nil {
+		return 0, err
+	}
+	return w.writeCompressedBlock(block, compressed)
+}
+
+// writeCompressedBlock writes compressed (the compressed contents of block)
+// to the underlying writer, or block if compression did not reduce its size.
+// It returns the on-disk size (including the uncompressed bit, if set).
+func (w *Writer) writeCompressedBlock(block, compressed []byte) (uint32, error) {
+	size := len(compressed)
+	if size >= len(block) {
 		// Copy uncompressed data: Linux returns i/o errors when it encounters a
 		// compressed block which is larger than the uncompressed data:
 		// https://github.com/torvalds/linux/blob/3ca24ce9ff764bc27bceb9b2fd8ece74846c3fd3/fs/squashfs/block.c#L150
 		size = len(block) | (1 << 24) // SQUASHFS_COMPRESSED_BIT_BLOCK
-		if _, err := f.w.w.Write(block); err != nil {
-			return err
+		if _, err := w.w.Write(block); err != nil {
+			return 0, err
 		}
+		w.dataEnd += int64(len(block))
 	} else {
-		if _, err := io.Copy(f.w.w, f.compBuf); err != nil {
-			return err
+		if _, err := w.w.Write(compressed); err != nil {
+			return 0, err
 		}
+		w.dataEnd += int64(len(compressed))
 	}
+	return uint32(size), nil
+}
 
-	f.blocksizes = append(f.blocksizes, uint32(size))
+// compress returns the compressed contents of block. The returned slice is
+// only valid until the next call to compress.
+func (w *Writer) compress(block []byte) ([]byte, error) {
+	var err error
+	w.compBuf, err = w.compressor.Compress(w.compBuf[:0], block)
+	return w.compBuf, err
+}
 
-	// Keep the rest in f.buf for the next write
-	copy(b, rest)
-	f.buf.Truncate(len(rest))
+// writeFragment appends tail (the last, partial block of a file) to the
+// current fragment block, writing the fragment block first if tail does not
+// fit. It returns the fragment index and offset within the fragment block.
+func (w *Writer) writeFragment(tail []byte) (fragment, offset uint32, err error) {
+	if w.fragBuf.Len()+len(tail) > dataBlockSize {
+		if err := w.flushFragment(); err != nil {
+			return 0, 0, err
+		}
+	}
+	fragment = uint32(len(w.fragments))
+	offset = uint32(w.fragBuf.Len())
+	w.fragBuf.Write(tail)
+	return fragment, offset, nil
+}
+
+// flushFragment writes the current fragment block (if any) and adds it to the
+// fragment table.
+func (w *Writer) flushFragment() error {
+	if w.fragBuf.Len() == 0 {
+		return nil
+	}
+	off, err := w.w.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	size, err := w.writeDataBlock(w.fragBuf.Bytes())
+	if err != nil {
+		return err
+	}
+	w.fragments = append(w.fragments, fragmentEntry{
+		Start: off,
+		Size:  size,
+	})
+	w.accountFragment(size)
+	w.fragBuf.Reset()
 	return nil
 }
 
 // Close implements io.Closer
 func (f *file) Close() error {
-	for f.buf.Len() > 0 {
+	if err := f.d.checkFlushed(); err != nil {
+		return err
+	}
+	// Write pending full blocks, then pack the remaining partial block into a
+	// fragment block shared with other files.
+	for f.buf.Len() >= dataBlockSize {
 		if err := f.writeBlock(); err != nil {
 			return err
 		}
 	}
-
-	startBlock := f.w.inodeBuf.Len() / metadataBlockSize
-	offset := f.w.inodeBuf.Len() - startBlock*metadataBlockSize
-
-	if err := binary.Write(&f.w.inodeBuf, binary.LittleEndian, regInodeHeader{
-		inodeHeader: inodeHeader{
-			InodeType:   fileType,
-			Mode:        uint16(f.mode),
-			Uid:         0,
-			Gid:         0,
-			Mtime:       int32(f.modTime.Unix()),
-			InodeNumber: f.w.sb.Inodes + 1,
-		},
-		StartBlock: uint32(f.off), // TODO(later): check for overflow
-		Fragment:   invalidFragment,
-		Offset:     0,
-		FileSize:   f.size,
-	}); err != nil {
+	if err := f.writePending(); err != nil {
 		return err
 	}
 
-	if err := binary.Write(&f.w.inodeBuf, binary.LittleEndian, f.blocksizes); err != nil {
+	f.stat = len(f.w.fileStats)
+	f.w.fileStats = append(f.w.fileStats, FileStat{
+		Path:       "/" + f.d.path(f.name),
+		InputBytes: f.size,
+	})
+	data, err := f.writeData()
+	if err != nil {
 		return err
 	}
 
-	f.d.dirEntries = append(f.d.dirEntries, fullDirEntry{
-		startBlock:  uint32(startBlock),
-		offset:      uint16(offset),
-		inodeNumber: f.w.sb.Inodes + 1,
-		entryType:   fileType,
-		name:        f.name,
-	})
-
-	f.w.sb.Inodes++
-
-	return nil
+	// The inode is written when the directory is flushed. Only capture the
+	// values it needs, not f (whose buffers would otherwise stay reachable).
+	var (
+		w   = f.w
+		hdr = inodeHeader{
+			InodeType:   fileType,
+			Mode:        unixPerm(f.mode),
+			Uid:         f.attrs.uid,
+			Gid:         f.attrs.gid,
+			Mtime:       f.mtime,
+			InodeNumber: f.w.allocateInode(),
+		}
+		size  = f.size
+		xattr = f.attrs.xattr
+	)
+	return f.d.addInode(f.name, &inodeRecord{
+		number:    hdr.InodeNumber,
+		entryType: fileType,
+		nlink:     1,
+		write: func(nlink uint32) error {
+			return w.writeRegInode(hdr, data, size, nlink, xattr)
+		},
+	}, lregInodeSizeEstimate+4*len(data.blocksizes))
 }
 
-// writeMetadataChunks copies from r to w in blocks of metadataBlockSize bytes
-// each, prefixing each block with a uint16 length header, setting the
-// uncompressed bit.
-func (w *Writer) writeMetadataChunks(r io.Reader) error {
-	buf := make([]byte, metadataBlockSize)
-	for {
-		buf = buf[:metadataBlockSize]
-		n, err := r.Read(buf)
-		if err != nil {
-			if err == io.EOF { // done
-				return nil
-			}
+// writeRegInode writes a regular file inode for a file of the specified size
+// whose contents are stored at data. The extended inode type is used if
+// necessary.
+func (w *Writer) writeRegInode(hdr inodeHeader, data fileData, size int64, nlink, xattr uint32) error {
+	if nlink > 1 ||
+		xattr != invalidXattr ||
+		data.sparse > 0 ||
+		data.startBlock > math.MaxUint32 ||
+		size > math.MaxUint32 {
+		// Only the extended inode type stores the link count, xattr index
+		// and sparse byte count, and supports 64-bit offsets and sizes.
+		hdr.InodeType = lregType
+		if err := binary.Write(&w.inodeBuf, binary.LittleEndian, lregInodeHeader{
+			inodeHeader: hdr,
+			StartBlock:  uint64(data.startBlock),
+			FileSize:    uint64(size),
+			Sparse:      uint64(data.sparse),
+			Nlink:       nlink,
+			Fragment:    data.fragment,
+			Offset:      data.fragOffset,
+			Xattr:       xattr,
+		}); err != nil {
 			return err
 		}
-		buf = buf[:n]
-		if err := binary.Write(w.w, binary.LittleEndian, uint16(len(buf))|0x8000); err != nil {
+	} else {
+		if err := binary.Write(&w.inodeBuf, binary.LittleEndian, regInodeHeader{
+			inodeHeader: hdr,
+			StartBlock:  uint32(data.startBlock),
+			Fragment:    data.fragment,
+			Offset:      data.fragOffset,
+			FileSize:    uint32(size),
+		}); err != nil {
 			return err
 		}
-		if _, err := w.w.Write(buf); err != nil {
-			return err
+	}
+	return binary.Write(&w.inodeBuf, binary.LittleEndian, data.blocksizes)
+}
+
+// writeData finishes writing the file contents (all full blocks must have been
+// written already) and returns their location. If a file with identical
+// contents was written before, its data is re-used and the blocks of f are
+// discarded.
+func (f *file) writeData() (fileData, error) {
+	var sum [sha256.Size]byte
+	f.hash.Sum(sum[:0])
+	if f.size > 0 {
+		if data, ok := f.w.dataByHash[sum]; ok {
+			// Rewind so that the next blocks overwrite the duplicate data.
+			end, err := f.w.w.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return fileData{}, err
+			}
+			f.w.discardedEnd = max(f.w.discardedEnd, end)
+			if _, err := f.w.w.Seek(f.off, io.SeekStart); err != nil {
+				return fileData{}, err
+			}
+			f.w.dataEnd = f.off
+			f.buf.Reset()
+			f.w.fileStats[f.stat].Duplicate = true
+			if data.previous {
+				f.w.previousUsed[sum] = true
+			}
+			return data, nil
+		}
+	}
+
+	// Pack the remaining partial block into a fragment block shared with
+	// other files.
+	data := fileData{
+		startBlock: f.off,
+		blocksizes: f.blocksizes,
+		fragment:   invalidFragment,
+		sparse:     f.sparse,
+	}
+	stat := &f.w.fileStats[f.stat]
+	for _, size := range f.blocksizes {
+		stat.StoredBytes += int64(size &^ (1 << 24))
+	}
+	if f.buf.Len() > 0 {
+		var err error
+		data.fragment, data.fragOffset, err = f.w.writeFragment(f.buf.Bytes())
+		if err != nil {
+			return fileData{}, err
+		}
+		f.w.fragmentTails = append(f.w.fragmentTails, fragmentTail{
+			stat: f.stat,
+			size: f.buf.Len(),
+		})
+		f.buf.Reset()
+	}
+	if f.size > 0 {
+		f.w.dataByHash[sum] = data
+		f.w.maxDataSize = max(f.w.maxDataSize, f.size)
+	}
+	return data, nil
+}
+
+// clearDiscarded removes data which was discarded by de-duplication and is
+// located past the end of the image (i.e. the current offset): regular files
+// are truncated, other writers (e.g. block devices) are overwritten with zeros
+// so that the result does not depend on previous contents.
+func (w *Writer) clearDiscarded() error {
+	end, err := w.w.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if w.discardedEnd <= end {
+		return nil
+	}
+	if f, ok := w.w.(*os.File); ok {
+		if st, err := f.Stat(); err == nil && st.Mode().IsRegular() {
+			return f.Truncate(end)
 		}
 	}
+	if _, err := w.w.Write(make([]byte, w.discardedEnd-end)); err != nil {
+		return err
+	}
+	_, err = w.w.Seek(end, io.SeekStart)
+	return err
 }
 
-// Flush writes the SquashFS file system. The Writer must not be used after
-// calling Flush.
+// Flush writes the SquashFS file system, flushing the Root directory (and all
+// its subdirectories) first unless it was already flushed explicitly. The
+// Writer must not be used after calling Flush.
 func (w *Writer) Flush() error {
+	defer func() {
+		// Remove temporary files in case Flush fails before writing all tables.
+		for _, mw := range w.metadataWriters() {
+			mw.out.Close()
+		}
+	}()
+	if w.err != nil {
+		return w.err
+	}
+	if err := w.resolveLinks(); err != nil {
+		return err
+	}
+	if !w.Root.flushed {
+		if err := w.Root.Flush(); err != nil {
+			return err
+		}
+	}
+	if w.err != nil {
+		return w.err
+	}
+
 	// (1) superblock will be written later
 
-	// (2) compressor-specific options omitted
+	// (2) compressor-specific options have already been written
 
-	// (3) data has already been written
+	// (3) data has already been written, except for the last fragment block
+	if err := w.flushFragment(); err != nil {
+		return err
+	}
+	if err := w.checkUnreferenced(); err != nil {
+		return err
+	}
 
 	// (4) write inode table
 	off, err := w.w.Seek(0, io.SeekCurrent)
@@ -680,7 +1781,7 @@ func (w *Writer) Flush() error {
 	}
 	w.sb.InodeTableStart = off
 
-	if err := w.writeMetadataChunks(&w.inodeBuf); err != nil {
+	if _, err := w.inodeBuf.WriteTo(w.w); err != nil {
 		return err
 	}
 
@@ -691,33 +1792,53 @@ func (w *Writer) Flush() error {
 	}
 	w.sb.DirectoryTableStart = off
 
-	if err := w.writeMetadataChunks(&w.dirBuf); err != nil {
+	if _, err := w.dirBuf.WriteTo(w.w); err != nil {
 		return err
 	}
 
-	// (6) fragment table omitted
-	off, err = w.w.Seek(0, io.SeekCurrent)
+	// (6) write fragment table
+	fragmentTableStart, err := w.writeTable(w.fragments, nil)
 	if err != nil {
 		return err
 	}
-	w.sb.FragmentTableStart = off
+	w.sb.FragmentTableStart = fragmentTableStart
+	w.sb.Fragments = uint32(len(w.fragments))
 
 	// (7) export table omitted
 
 	// (8) write uid/gid lookup table
-	idTableStart, err := writeIdTable(w.w, []uint32{0})
+	if len(w.ids) == 0 {
+		// The id table must contain at least one entry.
+		w.ids = append(w.ids, 0)
+	}
+	idTableStart, err := w.writeTable(w.ids, nil)
 	if err != nil {
 		return err
 	}
 	w.sb.IdTableStart = idTableStart
+	w.sb.NoIds = uint16(len(w.ids))
 
-	// (9) xattr table omitted
+	// (9) write xattr tables
+	if len(w.xattrIds) > 0 {
+		xattrIdTableStart, err := w.writeXattrTables()
+		if err != nil {
+			return err
+		}
+		w.sb.XattrIdTableStart = xattrIdTableStart
+	}
 
 	off, err = w.w.Seek(0, io.SeekCurrent)
 	if err != nil {
 		return err
 	}
 	w.sb.BytesUsed = off
+	w.imageSize = (off + 4095) &^ 4095
+	if w.maxSize > 0 && w.imageSize > w.maxSize {
+		return &SizeError{
+			MaxSize: w.maxSize,
+			Size:    w.imageSize,
+		}
+	}
 
 	// Pad to 4096, required for the kernel to be able to access all pages
 	if pad := off % 4096; pad > 0 {
@@ -727,7 +1848,12 @@ func (w *Writer) Flush() error {
 		}
 	}
 
+	if err := w.clearDiscarded(); err != nil {
+		return err
+	}
+
 	// (1) Write superblock
+	w.sb.Flags = w.filesystemFlags()
 	if _, err := w.w.Seek(0, io.SeekStart); err != nil {
 		return err
 	}
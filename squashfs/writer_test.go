@@ -2,15 +2,25 @@ package squashfs
 
 import (
 	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
 	"flag"
+	"fmt"
 	"io"
+	"io/fs"
 	"io/ioutil"
+	"math"
+	"math/rand"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"testing"
+	"testing/fstest"
 	"time"
+	"weak"
 )
 
 var fsImagePath = flag.String("fs_image_path", "", "Store the SquashFS test file system in the specified path for manual inspection")
@@ -77,9 +87,9 @@ func TestUnsquashfs(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	subdir := w.Root.Directory("subdir", time.Now())
+	subdir := addTestDirectory(t, w.Root, "subdir", time.Now(), 0o555)
 
-	subsubdir := subdir.Directory("deep", time.Now())
+	subsubdir := addTestDirectory(t, subdir, "deep", time.Now(), 0o555)
 	ff, err = subsubdir.File("yo", time.Now(), 0o444 /* u=r,g=r,o=r */)
 	if err != nil {
 		t.Fatal(err)
@@ -184,3 +194,1235 @@ func TestUnsquashfs(t *testing.T) {
 		})
 	}
 }
+
+func TestFragments(t *testing.T) {
+	t.Parallel()
+
+	contents := func(i int) []byte {
+		return bytes.Repeat([]byte{byte(i)}, 1000+i)
+	}
+	const files = 300
+	f := writeTestImage(t, func(w *Writer) {
+		for i := 0; i < files; i++ {
+			writeTestFile(t, w.Root, fmt.Sprintf("file%03d", i), 0o444, contents(i))
+		}
+		// A file consisting of a full block plus a tail end.
+		writeTestFile(t, w.Root, "zlarge", 0o444, contents(dataBlockSize))
+	})
+
+	r, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 300 files of 1000 to 1299 bytes plus a 1000 byte tail (≈ 338 KiB) fit
+	// into 3 fragment blocks.
+	if got, want := r.sb.Fragments, uint32(3); got != want {
+		t.Errorf("unexpected number of fragments: got %d, want %d", got, want)
+	}
+	for i := 0; i < files; i++ {
+		name := fmt.Sprintf("file%03d", i)
+		got, err := fs.ReadFile(r, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, contents(i)) {
+			t.Errorf("path %q differs", name)
+		}
+	}
+	got, err := fs.ReadFile(r, "zlarge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, contents(dataBlockSize)) {
+		t.Errorf("path %q differs", "zlarge")
+	}
+}
+
+func TestMetadataCompression(t *testing.T) {
+	t.Parallel()
+
+	fill := func(w *Writer) {
+		for i := 0; i < 10; i++ {
+			dir := addTestDirectory(t, w.Root, fmt.Sprintf("dir%d", i), time.Now(), 0o755)
+			for j := 0; j < 500; j++ {
+				writeTestFile(t, dir, fmt.Sprintf("file-with-a-long-name-%04d", j), 0o444, []byte(fmt.Sprint(j)))
+			}
+			if err := dir.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	metadataSize := make(map[bool]int64)
+	for _, compressed := range []bool{false, true} {
+		var opts []Option
+		if compressed {
+			opts = append(opts, WithMetadataCompression())
+		}
+		f := writeTestImage(t, fill, opts...)
+		r, err := NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		metadataSize[compressed] = r.sb.FragmentTableStart - r.sb.InodeTableStart
+		for i := 0; i < 10; i++ {
+			for _, j := range []int{0, 123, 499} {
+				name := fmt.Sprintf("dir%d/file-with-a-long-name-%04d", i, j)
+				got, err := fs.ReadFile(r, name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want := fmt.Sprint(j); string(got) != want {
+					t.Errorf("path %q: got %q, want %q", name, got, want)
+				}
+			}
+			entries, err := r.ReadDir(fmt.Sprintf("dir%d", i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := len(entries), 500; got != want {
+				t.Errorf("dir%d: got %d entries, want %d", i, got, want)
+			}
+		}
+	}
+	if metadataSize[true] >= metadataSize[false]/2 {
+		t.Errorf("compressed metadata unexpectedly large: %d bytes compressed, %d bytes uncompressed", metadataSize[true], metadataSize[false])
+	}
+}
+
+func TestCompressors(t *testing.T) {
+	t.Parallel()
+
+	compressible := bytes.Repeat([]byte("gokrazy compressor test "), 20000)
+	for _, entry := range []struct {
+		name       string
+		compressor Compressor
+		id         uint16
+	}{
+		{"zlib", Zlib(zlib.BestCompression), zlibCompression},
+		{"xz", XZ(), xzCompression},
+		{"lz4", LZ4(false), lz4Compression},
+		{"lz4hc", LZ4(true), lz4Compression},
+		{"zstd", Zstd(3), zstdCompression},
+		{"uncompressed", Uncompressed(), zlibCompression},
+	} {
+		entry := entry // copy
+		t.Run(entry.name, func(t *testing.T) {
+			t.Parallel()
+
+			f := writeTestImage(t, func(w *Writer) {
+				writeTestFile(t, w.Root, "compressible", 0o444, compressible)
+				writeTestFile(t, w.Root, "small", 0o444, []byte("hello world\n"))
+			}, WithCompressor(entry.compressor), WithMetadataCompression())
+			r, err := NewReader(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := r.sb.Compression, entry.id; got != want {
+				t.Errorf("unexpected compression id: got %d, want %d", got, want)
+			}
+			// noI, noD and noF: uncompressed inodes, data and fragments.
+			const uncompressedFlags = 1<<0 | 1<<1 | 1<<3
+			if entry.name == "uncompressed" && r.sb.Flags&uncompressedFlags != uncompressedFlags {
+				t.Errorf("superblock flags %#x lack %#x for an uncompressed image", r.sb.Flags, uncompressedFlags)
+			}
+			got, err := fs.ReadFile(r, "compressible")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, compressible) {
+				t.Errorf("path %q differs", "compressible")
+			}
+			got, err = fs.ReadFile(r, "small")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := "hello world\n"; string(got) != want {
+				t.Errorf("path %q: got %q, want %q", "small", got, want)
+			}
+			compressed := r.sb.BytesUsed < int64(len(compressible))
+			if want := entry.name != "uncompressed"; compressed != want {
+				t.Errorf("image size %d bytes for %d bytes of compressible data", r.sb.BytesUsed, len(compressible))
+			}
+		})
+	}
+}
+
+func TestCompressorLevels(t *testing.T) {
+	t.Parallel()
+
+	for _, c := range []Compressor{
+		Zlib(zlib.NoCompression),
+		Zlib(zlib.BestCompression + 1),
+		Zlib(zlib.HuffmanOnly),
+		Zstd(0),
+		Zstd(23),
+	} {
+		f, err := os.Create(filepath.Join(t.TempDir(), "squashfs"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := NewWriter(f, time.Now(), WithCompressor(c)); err == nil {
+			t.Errorf("NewWriter(WithCompressor(%+v)) unexpectedly succeeded", c)
+		}
+	}
+
+	// Like mksquashfs(1), zlib.DefaultCompression selects level 9, which is
+	// the default and hence not stored in the compressor options.
+	if opts := Zlib(zlib.DefaultCompression).Options(); opts != nil {
+		t.Errorf("Zlib(DefaultCompression).Options() = %x, want nil", opts)
+	}
+}
+
+// TestUncompressedUnsquashfs verifies that unsquashfs(1) can extract images
+// without any compressed blocks, which it recognizes by the superblock flags.
+func TestUncompressedUnsquashfs(t *testing.T) {
+	t.Parallel()
+
+	if _, err := exec.LookPath("unsquashfs"); err != nil {
+		t.Skip("unsquashfs not found in $PATH")
+	}
+	contents := bytes.Repeat([]byte("gokrazy uncompressed test "), 10000)
+	f := writeTestImage(t, func(w *Writer) {
+		writeTestFile(t, w.Root, "large", 0o444, contents)
+		writeTestFile(t, w.Root, "small", 0o444, []byte("hello world\n"))
+	}, WithCompressor(Uncompressed()))
+	out := filepath.Join(t.TempDir(), "x")
+	cmd := exec.Command("unsquashfs", "-d", out, f.Name())
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string][]byte{
+		"large": contents,
+		"small": []byte("hello world\n"),
+	} {
+		got, err := os.ReadFile(filepath.Join(out, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("path %q differs", name)
+		}
+	}
+}
+
+func TestDeduplication(t *testing.T) {
+	t.Parallel()
+
+	// incompressible contents, so that the image size reflects the number of
+	// stored copies
+	contents := make([]byte, 3*dataBlockSize+100)
+	rand.New(rand.NewSource(1)).Read(contents)
+
+	f := writeTestImage(t, func(w *Writer) {
+		writeTestFile(t, w.Root, "a", 0o444, contents)
+		writeTestFile(t, w.Root, "b", 0o444, contents)
+		writeTestFile(t, w.Root, "c", 0o444, contents[:len(contents)-1])
+		writeTestFile(t, w.Root, "d", 0o444, contents)
+	})
+	r, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Expect two copies: one for a, b and d, one for c.
+	if got, limit := r.sb.BytesUsed, int64(2*len(contents)+8192); got > limit {
+		t.Errorf("image unexpectedly large: got %d bytes, want <= %d bytes", got, limit)
+	}
+	st, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := st.Size(), (r.sb.BytesUsed+4095)/4096*4096; got != want {
+		t.Errorf("unexpected file size: got %d bytes, want %d bytes", got, want)
+	}
+	for name, want := range map[string][]byte{
+		"a": contents,
+		"b": contents,
+		"c": contents[:len(contents)-1],
+		"d": contents,
+	} {
+		got, err := fs.ReadFile(r, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("path %q differs", name)
+		}
+	}
+}
+
+func TestHardLinks(t *testing.T) {
+	t.Parallel()
+
+	busybox := bytes.Repeat([]byte("busybox "), 1000)
+	f := writeTestImage(t, func(w *Writer) {
+		bin := addTestDirectory(t, w.Root, "bin", time.Now(), 0o755)
+		writeTestFile(t, bin, "busybox", 0o755, busybox)
+		if err := bin.Link("sh", "bin/busybox"); err != nil {
+			t.Fatal(err)
+		}
+		sbin := addTestDirectory(t, w.Root, "sbin", time.Now(), 0o755)
+		if err := sbin.Link("init", "/bin/busybox"); err != nil {
+			t.Fatal(err)
+		}
+		if err := sbin.Symlink("init", "start", time.Now(), 0o777); err != nil {
+			t.Fatal(err)
+		}
+		if err := sbin.Link("zstart", "sbin/start"); err != nil {
+			t.Fatal(err)
+		}
+		if err := bin.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if err := sbin.Link("zzz", "bin/busybox"); err == nil {
+			t.Errorf("Link to a file in a flushed directory unexpectedly succeeded")
+		}
+		if err := sbin.Link("zzz", "bin/nonexistent"); err == nil {
+			t.Errorf("Link to a nonexistent file unexpectedly succeeded")
+		}
+		if err := sbin.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	r, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stat := func(name string) *Stat {
+		t.Helper()
+		fi, err := r.Lstat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi.Sys().(*Stat)
+	}
+	busyboxStat := stat("bin/busybox")
+	if got, want := busyboxStat.Nlink, uint32(3); got != want {
+		t.Errorf("bin/busybox: unexpected link count: got %d, want %d", got, want)
+	}
+	for _, name := range []string{"bin/sh", "sbin/init"} {
+		if got, want := stat(name).Inode, busyboxStat.Inode; got != want {
+			t.Errorf("%s: unexpected inode number: got %d, want %d", name, got, want)
+		}
+		got, err := fs.ReadFile(r, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, busybox) {
+			t.Errorf("path %q differs", name)
+		}
+	}
+	if got, want := stat("sbin/zstart").Nlink, uint32(2); got != want {
+		t.Errorf("sbin/zstart: unexpected link count: got %d, want %d", got, want)
+	}
+	// Directory link counts include . and the entry in the parent directory.
+	if got, want := stat(".").Nlink, uint32(4); got != want {
+		t.Errorf("root directory: unexpected link count: got %d, want %d", got, want)
+	}
+	if got, want := stat("bin").Nlink, uint32(2); got != want {
+		t.Errorf("bin: unexpected link count: got %d, want %d", got, want)
+	}
+}
+
+func TestFileReleasedOnClose(t *testing.T) {
+	t.Parallel()
+
+	writeTestImage(t, func(w *Writer) {
+		ff, err := w.Root.File("large", time.Now(), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ff.Write(bytes.Repeat([]byte("gokrazy "), dataBlockSize)); err != nil {
+			t.Fatal(err)
+		}
+		wp := weak.Make(ff.(*file))
+		if err := ff.Close(); err != nil {
+			t.Fatal(err)
+		}
+		ff = nil
+		// The inode of the file is written when Root is flushed, but the
+		// buffers of the file must not be retained until then.
+		runtime.GC()
+		if wp.Value() != nil {
+			t.Errorf("file still reachable after Close")
+		}
+	})
+}
+
+func TestSpecialFiles(t *testing.T) {
+	t.Parallel()
+
+	f := writeTestImage(t, func(w *Writer) {
+		dev := addTestDirectory(t, w.Root, "dev", time.Now(), 0o755)
+		if err := dev.Device("large", 240, 300000, time.Now(), 0o600|os.ModeDevice|os.ModeCharDevice); err != nil {
+			t.Fatal(err)
+		}
+		if err := dev.Device("null", 1, 3, time.Now(), 0o666|os.ModeDevice|os.ModeCharDevice); err != nil {
+			t.Fatal(err)
+		}
+		if err := dev.Device("sda", 8, 0, time.Now(), 0o660|os.ModeDevice); err != nil {
+			t.Fatal(err)
+		}
+		if err := dev.Fifo("xconsole", time.Now(), 0o640); err != nil {
+			t.Fatal(err)
+		}
+		for _, num := range [][2]uint32{{1 << 12, 0}, {0, 1 << 20}} {
+			if err := dev.Device("invalid", num[0], num[1], time.Now(), 0o600|os.ModeDevice); err == nil {
+				t.Errorf("Device(%d:%d) unexpectedly succeeded", num[0], num[1])
+			}
+		}
+		if err := dev.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		run := addTestDirectory(t, w.Root, "run", time.Now(), 0o755)
+		if err := run.Socket("sock", time.Now(), 0o777); err != nil {
+			t.Fatal(err)
+		}
+		if err := run.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	r, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(r, "dev/large", "dev/null", "dev/sda", "dev/xconsole", "run/sock"); err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range []struct {
+		path         string
+		mode         fs.FileMode
+		major, minor uint32
+	}{
+		{"dev/large", 0o600 | fs.ModeDevice | fs.ModeCharDevice, 240, 300000},
+		{"dev/null", 0o666 | fs.ModeDevice | fs.ModeCharDevice, 1, 3},
+		{"dev/sda", 0o660 | fs.ModeDevice, 8, 0},
+		{"dev/xconsole", 0o640 | fs.ModeNamedPipe, 0, 0},
+		{"run/sock", 0o777 | fs.ModeSocket, 0, 0},
+	} {
+		fi, err := r.Lstat(entry.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := fi.Mode(), entry.mode; got != want {
+			t.Errorf("%s: unexpected mode: got %v, want %v", entry.path, got, want)
+		}
+		st := fi.Sys().(*Stat)
+		if st.Major() != entry.major || st.Minor() != entry.minor {
+			t.Errorf("%s: unexpected device number: got %d:%d, want %d:%d", entry.path, st.Major(), st.Minor(), entry.major, entry.minor)
+		}
+	}
+}
+
+func TestXattrs(t *testing.T) {
+	t.Parallel()
+
+	caps := WithCapabilities(CapNetBindService)
+	label := WithXattr("security.selinux", []byte("system_u:object_r:bin_t:s0"))
+	var xattrIds int
+	f := writeTestImage(t, func(w *Writer) {
+		// Entries are created in sorted order, as required by Writer.
+		etc := addTestDirectory(t, w.Root, "etc", time.Now(), 0o755, label)
+		if err := etc.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Root.Fifo("fifo", time.Now(), 0o600, label); err != nil {
+			t.Fatal(err)
+		}
+		writeExecutable := func(name string) {
+			ff, err := w.Root.File(name, time.Now(), 0o755, caps, WithXattr("user.origin", []byte("gokrazy")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ff.Write([]byte("#!/bin/sh\n")); err != nil {
+				t.Fatal(err)
+			}
+			if err := ff.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		writeExecutable("httpd")
+		if err := w.Root.Fifo("large", time.Now(), 0o600, WithXattr("user.large", make([]byte, 64*1024))); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Root.Symlink("httpd", "link", time.Now(), 0o777, label); err != nil {
+			t.Fatal(err)
+		}
+		writeExecutable("ntpd")
+		writeTestFile(t, w.Root, "plain", 0o644, []byte("no xattrs"))
+		for _, tt := range []struct {
+			desc string
+			opts []EntryOption
+		}{
+			{"system namespace", []EntryOption{WithXattr("system.posix_acl_access", nil)}},
+			{"long name", []EntryOption{WithXattr("user."+strings.Repeat("x", 251), nil)}},
+			{"large value", []EntryOption{WithXattr("user.large", make([]byte, 64*1024+1))}},
+			{"duplicate name", []EntryOption{WithXattr("user.a", nil), WithXattr("user.a", []byte("again"))}},
+			{"capability 64", []EntryOption{WithCapabilities(64)}},
+			{"capability -1", []EntryOption{WithCapabilities(-1)}},
+		} {
+			if _, err := w.Root.File("invalid", time.Now(), 0o644, tt.opts...); err == nil {
+				t.Errorf("File with %s xattr unexpectedly succeeded", tt.desc)
+			}
+			if _, err := w.Root.Directory("invalid", time.Now(), 0o755, tt.opts...); err == nil {
+				t.Errorf("Directory with %s xattr unexpectedly succeeded", tt.desc)
+			}
+		}
+		xattrIds = len(w.xattrIds)
+	})
+	// httpd and ntpd share one set, link, fifo and etc share another, large
+	// has its own.
+	if got, want := xattrIds, 3; got != want {
+		t.Errorf("unexpected number of xattr ids: got %d, want %d", got, want)
+	}
+
+	r, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(r, "httpd", "ntpd", "plain", "link", "fifo", "etc", "large"); err != nil {
+		t.Fatal(err)
+	}
+	wantCaps := []byte{
+		0x01, 0x00, 0x00, 0x02, // VFS_CAP_REVISION_2 | VFS_CAP_FLAGS_EFFECTIVE
+		0x00, 0x04, 0x00, 0x00, // permitted: CAP_NET_BIND_SERVICE
+		0x00, 0x00, 0x00, 0x00, // inheritable
+		0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00,
+	}
+	for _, entry := range []struct {
+		path string
+		want []Xattr
+	}{
+		{"httpd", []Xattr{
+			{Name: "security.capability", Value: wantCaps},
+			{Name: "user.origin", Value: []byte("gokrazy")},
+		}},
+		{"ntpd", []Xattr{
+			{Name: "security.capability", Value: wantCaps},
+			{Name: "user.origin", Value: []byte("gokrazy")},
+		}},
+		{"plain", nil},
+		{"link", []Xattr{{Name: "security.selinux", Value: []byte("system_u:object_r:bin_t:s0")}}},
+		{"fifo", []Xattr{{Name: "security.selinux", Value: []byte("system_u:object_r:bin_t:s0")}}},
+		{"etc", []Xattr{{Name: "security.selinux", Value: []byte("system_u:object_r:bin_t:s0")}}},
+		{"large", []Xattr{{Name: "user.large", Value: make([]byte, 64*1024)}}},
+	} {
+		got, err := r.Xattrs(entry.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(entry.want) {
+			t.Errorf("Xattrs(%s) = %v, want %v", entry.path, got, entry.want)
+		}
+	}
+}
+
+func TestOwnership(t *testing.T) {
+	t.Parallel()
+
+	var ids []uint32
+	f := writeTestImage(t, func(w *Writer) {
+		perm := addTestDirectory(t, w.Root, "perm", time.Now(), 0o755, WithOwner(1000, 1000))
+		ff, err := perm.File("state", time.Now(), 0o600, WithOwner(1000, 100))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ff.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := perm.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		writeTestFile(t, w.Root, "root", 0o644, nil)
+		if err := w.Root.Symlink("perm/state", "state", time.Now(), 0o777, WithOwner(65534, 65534)); err != nil {
+			t.Fatal(err)
+		}
+		ids = w.ids
+	})
+	if got, want := fmt.Sprint(ids), "[0 1000 100 65534]"; got != want {
+		t.Errorf("unexpected id table: got %s, want %s", got, want)
+	}
+
+	r, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range []struct {
+		path     string
+		uid, gid uint32
+	}{
+		{"perm", 1000, 1000},
+		{"perm/state", 1000, 100},
+		{"root", 0, 0},
+		{"state", 65534, 65534},
+		{".", 0, 0},
+	} {
+		fi, err := r.Lstat(entry.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		st := fi.Sys().(*Stat)
+		if st.Uid != entry.uid || st.Gid != entry.gid {
+			t.Errorf("%s: unexpected owner: got %d:%d, want %d:%d", entry.path, st.Uid, st.Gid, entry.uid, entry.gid)
+		}
+	}
+}
+
+func TestIdTableLimit(t *testing.T) {
+	t.Parallel()
+
+	f := writeTestImage(t, func(w *Writer) {
+		for id := uint32(0); id < maxIds; id++ {
+			if _, err := w.idIndex(id); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := w.Root.File("overflow", time.Now(), 0o644, WithOwner(maxIds, 0)); err == nil {
+			t.Errorf("File with %d distinct ids unexpectedly succeeded", maxIds+1)
+		}
+	})
+	r, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(r.ids), maxIds; got != want {
+		t.Errorf("unexpected number of ids: got %d, want %d", got, want)
+	}
+}
+
+func TestDirectoryMode(t *testing.T) {
+	t.Parallel()
+
+	mtime := time.Unix(1234567890, 0)
+	f := writeTestImage(t, func(w *Writer) {
+		for _, dir := range []struct {
+			name string
+			mode os.FileMode
+		}{
+			{"etc", 0o755},
+			{"perm", 0o700},
+			{"shared", 0o775 | os.ModeSetgid},
+			{"ssh", 0o750},
+			{"tmp", 0o777 | os.ModeSticky},
+		} {
+			d := addTestDirectory(t, w.Root, dir.name, mtime, dir.mode, WithOwner(1000, 1000))
+			if err := d.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+	r, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range []struct {
+		path string
+		mode fs.FileMode
+	}{
+		{".", 0o555 | fs.ModeDir},
+		{"etc", 0o755 | fs.ModeDir},
+		{"perm", 0o700 | fs.ModeDir},
+		{"shared", 0o775 | fs.ModeDir | fs.ModeSetgid},
+		{"ssh", 0o750 | fs.ModeDir},
+		{"tmp", 0o777 | fs.ModeDir | fs.ModeSticky},
+	} {
+		fi, err := r.Stat(entry.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := fi.Mode(), entry.mode; got != want {
+			t.Errorf("%s: unexpected mode: got %v, want %v", entry.path, got, want)
+		}
+		if entry.path == "." {
+			continue
+		}
+		if got, want := fi.ModTime(), mtime; !got.Equal(want) {
+			t.Errorf("%s: unexpected mtime: got %v, want %v", entry.path, got, want)
+		}
+		if st := fi.Sys().(*Stat); st.Uid != 1000 || st.Gid != 1000 {
+			t.Errorf("%s: unexpected owner: got %d:%d, want 1000:1000", entry.path, st.Uid, st.Gid)
+		}
+	}
+}
+
+func TestClampTime(t *testing.T) {
+	t.Parallel()
+
+	epoch := time.Unix(1500000000, 0)
+	old := time.Unix(1234567890, 0)
+	build := func(now time.Time) []byte {
+		f := writeTestImage(t, func(w *Writer) {
+			etc := addTestDirectory(t, w.Root, "etc", now, 0o755)
+			if err := etc.Symlink("/proc/self/mounts", "mtab", now, 0o777); err != nil {
+				t.Fatal(err)
+			}
+			ff, err := etc.File("hostname", now, 0o644, WithXattr("user.origin", []byte("gokrazy")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ff.Write(bytes.Repeat([]byte("gokrazy\n"), 20000)); err != nil {
+				t.Fatal(err)
+			}
+			if err := ff.Close(); err != nil {
+				t.Fatal(err)
+			}
+			writeTestFile(t, w.Root, "old", 0o644, []byte("old")) // mtime is old
+		}, WithClampTime(epoch), WithMetadataCompression())
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	first := build(time.Now())
+	second := build(time.Now().Add(1 * time.Hour))
+	if !bytes.Equal(first, second) {
+		t.Fatalf("images differ despite WithClampTime")
+	}
+
+	r, err := NewReader(bytes.NewReader(first))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range []struct {
+		path    string
+		modTime time.Time
+	}{
+		{".", epoch},
+		{"etc", epoch},
+		{"etc/hostname", epoch},
+		{"etc/mtab", epoch},
+		{"old", old},
+	} {
+		fi, err := r.Lstat(entry.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := fi.ModTime(), entry.modTime; !got.Equal(want) {
+			t.Errorf("%s: unexpected mtime: got %v, want %v", entry.path, got, want)
+		}
+	}
+}
+
+func TestSourceDateEpoch(t *testing.T) {
+	t.Setenv("SOURCE_DATE_EPOCH", "")
+	if _, ok, err := SourceDateEpoch(); ok || err != nil {
+		t.Errorf("SourceDateEpoch() = _, %v, %v, want false, nil", ok, err)
+	}
+	t.Setenv("SOURCE_DATE_EPOCH", "1500000000")
+	epoch, ok, err := SourceDateEpoch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || !epoch.Equal(time.Unix(1500000000, 0)) {
+		t.Errorf("SourceDateEpoch() = %v, %v, want %v, true", epoch, ok, time.Unix(1500000000, 0))
+	}
+	t.Setenv("SOURCE_DATE_EPOCH", "yesterday")
+	if _, _, err := SourceDateEpoch(); err == nil {
+		t.Errorf("SourceDateEpoch() unexpectedly succeeded for an invalid value")
+	}
+}
+
+func TestParallelism(t *testing.T) {
+	t.Parallel()
+
+	rnd := rand.New(rand.NewSource(1))
+	contents := make([][]byte, 4)
+	for i := range contents {
+		// Half random (incompressible), half repetitive data, spanning many
+		// blocks with a partial tail block.
+		b := make([]byte, 20*dataBlockSize+i*1000)
+		rnd.Read(b[:len(b)/2])
+		copy(b[len(b)/2:], bytes.Repeat([]byte{byte(i)}, len(b)/2))
+		contents[i] = b
+	}
+	build := func(parallelism int) []byte {
+		f := writeTestImage(t, func(w *Writer) {
+			for i, b := range contents {
+				writeTestFile(t, w.Root, fmt.Sprintf("file%d", i), 0o644, b)
+			}
+		}, WithParallelism(parallelism), WithClampTime(time.Unix(1234567890, 0))) // pin mkfsTime
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	sequential := build(1)
+	parallel := build(16)
+	if !bytes.Equal(sequential, parallel) {
+		t.Fatalf("images differ between parallelism 1 and 16")
+	}
+	r, err := NewReader(bytes.NewReader(parallel))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range contents {
+		got, err := fs.ReadFile(r, fmt.Sprintf("file%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("file%d: contents differ", i)
+		}
+	}
+}
+
+func TestMetadataSpill(t *testing.T) {
+	t.Parallel()
+
+	build := func(opts ...Option) []byte {
+		opts = append(opts, WithClampTime(time.Unix(1234567890, 0))) // pin mkfsTime
+		f := writeTestImage(t, func(w *Writer) {
+			for i := 0; i < 2000; i++ {
+				dir := fmt.Sprintf("/dir%02d", i%20)
+				if err := w.AddSymlink("/target", fmt.Sprintf("%s/link%04d", dir, i), time.Now(), 0o777); err != nil {
+					t.Fatal(err)
+				}
+				if err := w.AddDirectory(fmt.Sprintf("%s/sub%04d", dir, i), time.Now(), 0o755, WithXattr("user.index", []byte(fmt.Sprint(i)))); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}, opts...)
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	inMemory := build()
+	for _, limit := range []int64{1, 3 * metadataBlockSize} {
+		for _, compress := range []bool{false, true} {
+			dir := t.TempDir()
+			opts := []Option{WithMetadataSpill(limit, dir)}
+			want := inMemory
+			if compress {
+				opts = append(opts, WithMetadataCompression())
+				want = build(WithMetadataCompression())
+			}
+			if got := build(opts...); !bytes.Equal(got, want) {
+				t.Errorf("limit %d, compression %v: image differs from in-memory image", limit, compress)
+			}
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) > 0 {
+				t.Errorf("limit %d: temporary files not removed: %v", limit, entries)
+			}
+		}
+	}
+}
+
+func TestMetadataSpillMemory(t *testing.T) {
+	// Not parallel, to measure the heap size of this test only.
+
+	heapAlloc := func() int64 {
+		runtime.GC()
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		return int64(ms.HeapAlloc)
+	}
+	for _, tt := range []struct {
+		kind string
+		// limit is the maximum memory per entry which remains in use once
+		// the directory containing the entry was flushed.
+		limit int64
+	}{
+		{"symlink", 32},
+		{"file", 300},   // de-duplication and FileStats
+		{"WriteFS", 32}, // symbolic links, flushed by WriteFS
+	} {
+		f, err := os.Create(filepath.Join(t.TempDir(), "squashfs"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		w, err := NewWriter(f, time.Now(), WithMetadataSpill(64<<10, t.TempDir()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		const dirs, entries = 40, 1000
+		var before int64
+		if tt.kind == "WriteFS" {
+			fsys := symlinkFS{dirs: dirs, entries: entries}
+			if err := WriteFS(w, fsys, WriteFSOptions{
+				Hook: func(e *FSEntry) (bool, error) {
+					if e.Path == "dir01" {
+						before = heapAlloc() // dir00 was flushed
+					}
+					return true, nil
+				},
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := 0; i < dirs && tt.kind != "WriteFS"; i++ {
+			dir := addTestDirectory(t, w.Root, fmt.Sprintf("dir%02d", i), time.Now(), 0o755)
+			for j := 0; j < entries; j++ {
+				name := fmt.Sprintf("%s%04d", tt.kind, j)
+				if tt.kind == "file" {
+					writeTestFile(t, dir, name, 0o644, []byte(name+dir.name))
+				} else if err := dir.Symlink("target", name, time.Now(), 0o777); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := dir.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			if i == 0 {
+				before = heapAlloc()
+			}
+		}
+		perEntry := (heapAlloc() - before) / ((dirs - 1) * entries)
+		t.Logf("%s: %d bytes per entry", tt.kind, perEntry)
+		if perEntry > tt.limit {
+			t.Errorf("%s: memory usage grows by %d bytes per entry, want at most %d bytes", tt.kind, perEntry, tt.limit)
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// symlinkFS is a file system with dirs directories, each containing entries
+// symbolic links, which are generated on demand (unlike fstest.MapFS, whose
+// memory usage would distort TestMetadataSpillMemory).
+type symlinkFS struct {
+	dirs, entries int
+}
+
+func (s symlinkFS) Open(name string) (fs.File, error) {
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+}
+
+func (s symlinkFS) Stat(name string) (fs.FileInfo, error) {
+	if name != "." {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	return symlinkFSInfo{name: ".", mode: fs.ModeDir | 0o755}, nil
+}
+
+func (s symlinkFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	var entries []fs.DirEntry
+	if name == "." {
+		for i := 0; i < s.dirs; i++ {
+			entries = append(entries, fs.FileInfoToDirEntry(symlinkFSInfo{name: fmt.Sprintf("dir%02d", i), mode: fs.ModeDir | 0o755}))
+		}
+		return entries, nil
+	}
+	for j := 0; j < s.entries; j++ {
+		entries = append(entries, fs.FileInfoToDirEntry(symlinkFSInfo{name: fmt.Sprintf("symlink%04d", j), mode: fs.ModeSymlink | 0o777}))
+	}
+	return entries, nil
+}
+
+func (s symlinkFS) ReadLink(name string) (string, error) { return "target", nil }
+
+type symlinkFSInfo struct {
+	name string
+	mode fs.FileMode
+}
+
+func (i symlinkFSInfo) Name() string       { return i.name }
+func (i symlinkFSInfo) Size() int64        { return 0 }
+func (i symlinkFSInfo) Mode() fs.FileMode  { return i.mode }
+func (i symlinkFSInfo) ModTime() time.Time { return time.Unix(1234567890, 0) }
+func (i symlinkFSInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i symlinkFSInfo) Sys() any           { return nil }
+
+var largeFiles = flag.Bool("large_files", false, "Run tests which write files larger than 4 GiB")
+
+func TestLargeFile(t *testing.T) {
+	if !*largeFiles {
+		t.Skip("skipping writing a file larger than 4 GiB without -large_files")
+	}
+	t.Parallel()
+
+	const size = 4<<30 + 12345
+	block := bytes.Repeat([]byte("large file "), dataBlockSize/11+1)[:dataBlockSize]
+	f := writeTestImage(t, func(w *Writer) {
+		ff, err := w.Root.File("large", time.Now(), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for written := int64(0); written < size; {
+			n, err := ff.Write(block[:min(int64(len(block)), size-written)])
+			if err != nil {
+				t.Fatal(err)
+			}
+			written += int64(n)
+		}
+		if err := ff.Close(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	r, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := r.Stat("large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fi.Size(), int64(size); got != want {
+		t.Errorf("unexpected size: got %d, want %d", got, want)
+	}
+	rf, err := r.Open("large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+	buf := make([]byte, 100)
+	n, err := rf.(io.ReaderAt).ReadAt(buf, size-int64(len(buf))+1)
+	if err != io.EOF || n != len(buf)-1 {
+		t.Errorf("ReadAt(end) = %d, %v, want %d, EOF", n, err, len(buf)-1)
+	}
+	off := int((size - 1) % dataBlockSize)
+	if !bytes.Equal(buf[:n], block[off-n+1:off+1]) {
+		t.Errorf("ReadAt(end) returned unexpected data")
+	}
+}
+
+func TestRegInodeOverflow(t *testing.T) {
+	t.Parallel()
+
+	w := &Writer{}
+	w.inodeBuf.w = w
+	for _, tt := range []struct {
+		startBlock, size int64
+		want             uint16
+	}{
+		{96, 1 << 20, fileType},
+		{96, math.MaxUint32, fileType},
+		{96, math.MaxUint32 + 1, lregType},
+		{math.MaxUint32 + 1, 1 << 20, lregType},
+	} {
+		w.inodeBuf.cur.Reset()
+		data := fileData{startBlock: tt.startBlock, fragment: invalidFragment}
+		if err := w.writeRegInode(inodeHeader{InodeType: fileType}, data, tt.size, 1, invalidXattr); err != nil {
+			t.Fatal(err)
+		}
+		var hdr inodeHeader
+		if err := binary.Read(bytes.NewReader(w.inodeBuf.cur.Bytes()), binary.LittleEndian, &hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.InodeType != tt.want {
+			t.Errorf("writeRegInode(start=%d, size=%d): got inode type %d, want %d", tt.startBlock, tt.size, hdr.InodeType, tt.want)
+		}
+	}
+}
+
+func TestInvalidEntries(t *testing.T) {
+	t.Parallel()
+
+	mtime := time.Unix(1234567890, 0)
+	f := writeTestImage(t, func(w *Writer) {
+		for _, name := range []string{"", ".", "..", "a/b", "nul\x00", strings.Repeat("x", 257)} {
+			if _, err := w.Root.File(name, mtime, 0o644); err == nil {
+				t.Errorf("File(%q) unexpectedly succeeded", name)
+			}
+			if _, err := w.Root.Directory(name, mtime, 0o755); err == nil {
+				t.Errorf("Directory(%q) unexpectedly succeeded", name)
+			}
+			if err := w.Root.Symlink("target", name, mtime, 0o777); err == nil {
+				t.Errorf("Symlink(%q) unexpectedly succeeded", name)
+			}
+			if err := w.Root.Fifo(name, mtime, 0o600); err == nil {
+				t.Errorf("Fifo(%q) unexpectedly succeeded", name)
+			}
+		}
+		for _, target := range []string{"", "nul\x00", strings.Repeat("x", 4097)} {
+			if err := w.Root.Symlink(target, "symlink", mtime, 0o777); err == nil {
+				t.Errorf("Symlink to %q unexpectedly succeeded", target)
+			}
+		}
+		if err := w.Root.Symlink(strings.Repeat("x", 4096), "symlink", mtime, 0o777); err != nil {
+			t.Fatal(err)
+		}
+		writeTestFile(t, w.Root, strings.Repeat("x", 256), 0o644, nil)
+		if err := w.Root.Link("link..", strings.Repeat("x", 256)); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, mtime := range []time.Time{
+			time.Unix(-1, 0),
+			time.Unix(math.MaxUint32+1, 0),
+		} {
+			if _, err := w.Root.File("file", mtime, 0o644); err == nil {
+				t.Errorf("File with mtime %v unexpectedly succeeded", mtime)
+			}
+			if _, err := w.Root.Directory("dir", mtime, 0o755); err == nil {
+				t.Errorf("Directory with mtime %v unexpectedly succeeded", mtime)
+			}
+			if err := w.AddDirectory("/", mtime, 0o755); err == nil {
+				t.Errorf("AddDirectory(/) with mtime %v unexpectedly succeeded", mtime)
+			}
+		}
+		if err := w.Root.Fifo("2106", time.Unix(math.MaxUint32, 0), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Root.Fifo("zero", time.Time{}, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	})
+	r, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]time.Time{
+		"2106": time.Unix(math.MaxUint32, 0),
+		"zero": time.Unix(0, 0),
+	} {
+		fi, err := r.Lstat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fi.ModTime(); !got.Equal(want) {
+			t.Errorf("%s: unexpected mtime: got %v, want %v", name, got, want)
+		}
+	}
+	if _, err := NewWriter(f, time.Unix(-1, 0)); err == nil {
+		t.Errorf("NewWriter with mkfsTime before 1970 unexpectedly succeeded")
+	}
+}
+
+func TestSparse(t *testing.T) {
+	t.Parallel()
+
+	// hole, data, hole, hole, partial tail
+	contents := make([]byte, 4*dataBlockSize+100)
+	copy(contents[dataBlockSize:], bytes.Repeat([]byte("data"), dataBlockSize/4))
+	copy(contents[4*dataBlockSize:], "tail")
+	f := writeTestImage(t, func(w *Writer) {
+		writeTestFile(t, w.Root, "empty.img", 0o644, make([]byte, 64*dataBlockSize))
+		writeTestFile(t, w.Root, "sparse", 0o644, contents)
+	})
+	st, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Size() > 3*dataBlockSize/2 {
+		t.Errorf("image unexpectedly large (%d bytes), holes not stored as sparse blocks?", st.Size())
+	}
+
+	r, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(r, "empty.img", "sparse"); err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range []struct {
+		path   string
+		want   []byte
+		sparse int64
+	}{
+		{"empty.img", make([]byte, 64*dataBlockSize), 64 * dataBlockSize},
+		{"sparse", contents, 3 * dataBlockSize},
+	} {
+		got, err := fs.ReadFile(r, entry.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, entry.want) {
+			t.Errorf("%s: contents differ", entry.path)
+		}
+		ino, err := r.lookup("stat", entry.path, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := ino.sparse, entry.sparse; got != want {
+			t.Errorf("%s: unexpected sparse byte count: got %d, want %d", entry.path, got, want)
+		}
+	}
+}
+
+func TestLargeDirectory(t *testing.T) {
+	t.Parallel()
+
+	const (
+		numFiles = 5000
+		// more than an int16 inode number delta, see dirHeaderRun
+		numSpread = 40000
+	)
+	for _, opts := range [][]Option{
+		nil,
+		{WithMetadataCompression()},
+	} {
+		f := writeTestImage(t, func(w *Writer) {
+			if err := w.AddSymlink("target", "/spread/first", time.Now(), 0o777); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < numSpread; i++ {
+				if err := w.AddFifo(fmt.Sprintf("/fifos/%05d", i), time.Now(), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.AddSymlink("target", "/spread/last", time.Now(), 0o777); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < numFiles; i++ {
+				if err := w.AddSymlink("target", fmt.Sprintf("/zoneinfo/Region%05d/City", i), time.Now(), 0o777); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}, opts...)
+
+		r, err := NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, dir := range []string{"fifos", "zoneinfo"} {
+			ino, err := r.lookup("stat", dir, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ino.index) == 0 {
+				t.Errorf("%s: no directory index", dir)
+			}
+		}
+		entries, err := r.ReadDir("zoneinfo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := len(entries), numFiles; got != want {
+			t.Errorf("ReadDir(zoneinfo) returned %d entries, want %d", got, want)
+		}
+		// Look up entries (using the directory index) throughout the directory.
+		for i := 0; i < numFiles; i += 97 {
+			name := fmt.Sprintf("zoneinfo/Region%05d/City", i)
+			if _, err := r.ReadLink(name); err != nil {
+				t.Errorf("ReadLink(%s): %v", name, err)
+			}
+		}
+		if _, err := r.Stat("zoneinfo/Region99999"); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Stat(zoneinfo/Region99999) = %v, want fs.ErrNotExist", err)
+		}
+
+		first, err := r.Lstat("spread/first")
+		if err != nil {
+			t.Fatal(err)
+		}
+		last, err := r.Lstat("spread/last")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, min := last.Sys().(*Stat).Inode-first.Sys().(*Stat).Inode, uint32(numSpread); got < min {
+			t.Errorf("inode number difference = %d, want at least %d", got, min)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package squashfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Xattr is an extended attribute.
+type Xattr struct {
+	// Name is the full name of the extended attribute, including its
+	// namespace prefix, e.g. security.capability.
+	Name  string `json:"name"`
+	Value []byte `json:"value"`
+}
+
+// WithXattr adds the extended attribute name (e.g. security.capability) with
+// the specified value. Only the user, trusted and security namespaces are
+// supported.
+func WithXattr(name string, value []byte) EntryOption {
+	return func(o *entryOptions) {
+		o.xattrs = append(o.xattrs, Xattr{Name: name, Value: value})
+	}
+}
+
+// CapNetBindService is the CAP_NET_BIND_SERVICE capability, which allows
+// binding to ports below 1024.
+const CapNetBindService = 10
+
+// WithCapabilities sets file capabilities (the security.capability extended
+// attribute), granting the specified capabilities (e.g. CapNetBindService) as
+// permitted and effective capabilities when executing the file. Capabilities
+// outside of [0, 63] result in an error when creating the entry.
+func WithCapabilities(caps ...int) EntryOption {
+	const (
+		vfsCapRevision2      = 0x02000000
+		vfsCapFlagsEffective = 0x000001
+	)
+	var permitted [2]uint32
+	for _, c := range caps {
+		if c < 0 || c >= 64 {
+			return func(o *entryOptions) {
+				o.err = fmt.Errorf("squashfs: invalid capability %d", c)
+			}
+		}
+		permitted[c/32] |= 1 << (c % 32)
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, struct {
+		MagicEtc     uint32
+		Permitted0   uint32
+		Inheritable0 uint32
+		Permitted1   uint32
+		Inheritable1 uint32
+	}{
+		MagicEtc:   vfsCapRevision2 | vfsCapFlagsEffective,
+		Permitted0: permitted[0],
+		Permitted1: permitted[1],
+	})
+	return WithXattr("security.capability", buf.Bytes())
+}
+
+// xattr namespace prefixes, as stored in xattrEntry.Type.
+const (
+	xattrUser = iota
+	xattrTrusted
+	xattrSecurity
+
+	// xattrValueOOL marks values which are stored out of line, i.e. the value
+	// is a reference to another value.
+	xattrValueOOL = 0x100
+
+	// maxXattrNameSize and maxXattrValueSize are the limits Linux enforces
+	// (XATTR_NAME_MAX and XATTR_SIZE_MAX), the latter is enforced by Reader.
+	maxXattrNameSize  = 255
+	maxXattrValueSize = 64 * 1024
+)
+
+var xattrPrefixes = []string{
+	xattrUser:     "user.",
+	xattrTrusted:  "trusted.",
+	xattrSecurity: "security.",
+}
+
+type xattrEntry struct {
+	Type uint16
+	Size uint16
+
+	// Followed by a byte array of Size bytes (the name without prefix), a
+	// uint32 value size and the value.
+}
+
+// xattrId is an entry in the xattr id table, describing a set of extended
+// attributes.
+type xattrId struct {
+	Xattr uint64 // reference into the xattr key/value table
+	Count uint32
+	Size  uint32
+}
+
+type xattrIdTable struct {
+	XattrTableStart int64
+	XattrIds        uint32
+	Unused          uint32
+}
+
+// xattrIndex returns the index of the xattr id table entry for xattrs, adding
+// an entry (and writing the extended attributes) unless an identical set of
+// extended attributes was written before. If xattrs is empty, invalidXattr is
+// returned.
+func (w *Writer) xattrIndex(xattrs []Xattr) (uint32, error) {
+	if len(xattrs) == 0 {
+		return invalidXattr, nil
+	}
+	xattrs = append([]Xattr(nil), xattrs...)
+	sort.SliceStable(xattrs, func(i, j int) bool {
+		return xattrs[i].Name < xattrs[j].Name
+	})
+	var (
+		buf  bytes.Buffer
+		size int
+	)
+	for i, x := range xattrs {
+		if i > 0 && x.Name == xattrs[i-1].Name {
+			return 0, fmt.Errorf("squashfs: duplicate xattr %q", x.Name)
+		}
+		if len(x.Name) > maxXattrNameSize {
+			return 0, fmt.Errorf("squashfs: xattr name %q too long (limit %d bytes)", x.Name, maxXattrNameSize)
+		}
+		if len(x.Value) > maxXattrValueSize {
+			return 0, fmt.Errorf("squashfs: xattr %q: value too large (%d bytes, limit %d bytes)", x.Name, len(x.Value), maxXattrValueSize)
+		}
+		typ := -1
+		for t, prefix := range xattrPrefixes {
+			if strings.HasPrefix(x.Name, prefix) && len(x.Name) > len(prefix) {
+				typ = t
+				break
+			}
+		}
+		if typ == -1 {
+			return 0, fmt.Errorf("squashfs: unsupported xattr %q: only user, trusted and security namespaces are supported", x.Name)
+		}
+		name := strings.TrimPrefix(x.Name, xattrPrefixes[typ])
+		binary.Write(&buf, binary.LittleEndian, xattrEntry{
+			Type: uint16(typ),
+			Size: uint16(len(name)),
+		})
+		buf.WriteString(name)
+		binary.Write(&buf, binary.LittleEndian, uint32(len(x.Value)))
+		buf.Write(x.Value)
+		size += len(x.Name) + 1 + len(x.Value)
+	}
+	key := buf.String()
+	if idx, ok := w.xattrIndexByKey[key]; ok {
+		return idx, nil
+	}
+	block, offset := w.xattrBuf.ref()
+	if _, err := w.xattrBuf.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	idx := uint32(len(w.xattrIds))
+	w.xattrIds = append(w.xattrIds, xattrId{
+		Xattr: uint64(block)<<16 | uint64(offset),
+		Count: uint32(len(xattrs)),
+		Size:  uint32(size),
+	})
+	w.xattrIndexByKey[key] = idx
+	return idx, nil
+}
+
+// writeXattrTables writes the xattr key/value table and the xattr id table,
+// returning the offset of the xattr id table header (for the superblock).
+func (w *Writer) writeXattrTables() (int64, error) {
+	xattrTableStart, err := w.w.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := w.xattrBuf.WriteTo(w.w); err != nil {
+		return 0, err
+	}
+	return w.writeTable(w.xattrIds, xattrIdTable{
+		XattrTableStart: xattrTableStart,
+		XattrIds:        uint32(len(w.xattrIds)),
+	})
+}
+
+// readXattrs reads the extended attributes with xattr id table index idx.
+func (r *Reader) readXattrs(idx uint32) ([]Xattr, error) {
+	if idx == invalidXattr {
+		return nil, nil
+	}
+	if r.sb.XattrIdTableStart == -1 {
+		return nil, fmt.Errorf("xattr index %d, but image has no xattr table", idx)
+	}
+	var hdr xattrIdTable
+	if err := binary.Read(io.NewSectionReader(r.r, r.sb.XattrIdTableStart, 16), binary.LittleEndian, &hdr); err != nil {
+		return nil, err
+	}
+	if idx >= hdr.XattrIds {
+		return nil, fmt.Errorf("xattr index %d out of range [0, %d)", idx, hdr.XattrIds)
+	}
+	// Read the metadata block containing the id table entry.
+	const idsPerBlock = metadataBlockSize / 16
+	var blockOff int64
+	if err := binary.Read(io.NewSectionReader(r.r, r.sb.XattrIdTableStart+16+8*int64(idx/idsPerBlock), 8), binary.LittleEndian, &blockOff); err != nil {
+		return nil, err
+	}
+	mr, err := r.metadataReader(blockOff, 0, uint16(16*(idx%idsPerBlock)))
+	if err != nil {
+		return nil, err
+	}
+	var id xattrId
+	if err := binary.Read(mr, binary.LittleEndian, &id); err != nil {
+		return nil, err
+	}
+
+	mr, err = r.metadataReader(hdr.XattrTableStart, uint32(id.Xattr>>16), uint16(id.Xattr&0xFFFF))
+	if err != nil {
+		return nil, err
+	}
+	// id.Count is not used to pre-allocate xattrs: it is read from the image,
+	// whereas each entry must actually be present in the xattr table.
+	var xattrs []Xattr
+	for i := uint32(0); i < id.Count; i++ {
+		var entry xattrEntry
+		if err := binary.Read(mr, binary.LittleEndian, &entry); err != nil {
+			return nil, err
+		}
+		typ := entry.Type &^ xattrValueOOL
+		if int(typ) >= len(xattrPrefixes) {
+			return nil, fmt.Errorf("unknown xattr type %d", typ)
+		}
+		name := make([]byte, entry.Size)
+		if _, err := io.ReadFull(mr, name); err != nil {
+			return nil, err
+		}
+		value, err := readXattrValue(mr)
+		if err != nil {
+			return nil, err
+		}
+		if entry.Type&xattrValueOOL != 0 {
+			if len(value) != 8 {
+				return nil, fmt.Errorf("invalid out of line xattr value reference")
+			}
+			ref := binary.LittleEndian.Uint64(value)
+			vr, err := r.metadataReader(hdr.XattrTableStart, uint32(ref>>16), uint16(ref&0xFFFF))
+			if err != nil {
+				return nil, err
+			}
+			if value, err = readXattrValue(vr); err != nil {
+				return nil, err
+			}
+		}
+		xattrs = append(xattrs, Xattr{
+			Name:  xattrPrefixes[typ] + string(name),
+			Value: value,
+		})
+	}
+	return xattrs, nil
+}
+
+func readXattrValue(r io.Reader) ([]byte, error) {
+	var size uint32
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return nil, err
+	}
+	if size > maxXattrValueSize {
+		return nil, fmt.Errorf("xattr value too large (%d bytes)", size)
+	}
+	value := make([]byte, size)
+	_, err := io.ReadFull(r, value)
+	return value, err
+}
+
+// Xattrs returns the extended attributes of the file name. A symbolic link
+// in the last path element is not followed.
+func (r *Reader) Xattrs(name string) ([]Xattr, error) {
+	ino, err := r.lookup("xattrs", name, false)
+	if err != nil {
+		return nil, err
+	}
+	xattrs, err := r.readXattrs(ino.xattr)
+	if err != nil {
+		return nil, fmt.Errorf("xattrs %s: %v", name, err)
+	}
+	return xattrs, nil
+}
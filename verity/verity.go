@@ -0,0 +1,233 @@
+// Package verity computes dm-verity hash trees (format version 1, as created by
+// veritysetup(8) with --no-superblock), which allow the Linux kernel to verify
+// the integrity of read-only file system images such as the gokrazy root file
+// system.
+//
+// The hash tree can either be appended to the image (see Append) or written to
+// a separate device (see Write). The resulting Tree contains the root hash and
+// the parameters for the kernel's verity target, see Tree.Params.
+package verity
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+)
+
+const (
+	defaultBlockSize = 4096
+	algorithm        = "sha256"
+	digestSize       = sha256.Size
+)
+
+// Options configures the hash tree. The zero value is valid and results in
+// the veritysetup(8) defaults, except for the salt.
+type Options struct {
+	// DataBlockSize is the size of data blocks in bytes, 4096 by default. It
+	// must be a power of two between 512 and 65536, and must not exceed the
+	// page size of the kernel which verifies the data.
+	DataBlockSize int
+
+	// HashBlockSize is the size of hash blocks in bytes, 4096 by default,
+	// with the same restrictions as DataBlockSize.
+	HashBlockSize int
+
+	// Salt is prepended to each block before hashing. veritysetup(8) uses a
+	// random 32 byte salt by default, but an empty salt is valid, too.
+	Salt []byte
+}
+
+func (o *Options) validate() error {
+	if o.DataBlockSize == 0 {
+		o.DataBlockSize = defaultBlockSize
+	}
+	if o.HashBlockSize == 0 {
+		o.HashBlockSize = defaultBlockSize
+	}
+	for _, bs := range []int{o.DataBlockSize, o.HashBlockSize} {
+		if bs < 512 || bs > 65536 || bs&(bs-1) != 0 {
+			return fmt.Errorf("verity: invalid block size %d: must be a power of two between 512 and 65536", bs)
+		}
+	}
+	if len(o.Salt) > 256 {
+		return fmt.Errorf("verity: salt too long (%d bytes, at most 256 supported)", len(o.Salt))
+	}
+	return nil
+}
+
+// Tree is a dm-verity hash tree.
+type Tree struct {
+	// RootHash is the hash of the top-level hash block, which needs to be
+	// passed to the kernel (e.g. on the kernel command line) from a trusted
+	// source.
+	RootHash []byte
+
+	DataBlockSize int
+	HashBlockSize int
+	Salt          []byte
+
+	// DataBlocks is the number of data blocks covered by the tree.
+	DataBlocks uint64
+
+	// HashOffset is the byte offset of the hash tree on the hash device,
+	// i.e. the size of the data for Append, and 0 for Write.
+	HashOffset int64
+
+	// levels contains the hash blocks of each level, the top-level first,
+	// which is the order in which they are stored on disk.
+	levels [][]byte
+}
+
+// Size returns the size of the hash tree in bytes.
+func (t *Tree) Size() int64 {
+	var size int64
+	for _, level := range t.levels {
+		size += int64(len(level))
+	}
+	return size
+}
+
+// WriteTo writes the hash tree to w.
+func (t *Tree) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	for _, level := range t.levels {
+		n, err := w.Write(level)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Params returns the parameters of the verity target for the kernel's device
+// mapper, for the specified data and hash devices (e.g. /dev/mmcblk0p2 or
+// PARTUUID=…, or major:minor). The hash device is the same as the data device
+// if the tree was appended.
+//
+// A complete table line is "0 <DataSectors> verity <Params>", e.g. for
+// use with dmsetup(8) or the dm-mod.create kernel parameter.
+func (t *Tree) Params(dataDev, hashDev string) string {
+	salt := "-"
+	if len(t.Salt) > 0 {
+		salt = hex.EncodeToString(t.Salt)
+	}
+	return fmt.Sprintf("1 %s %s %d %d %d %d %s %s %s",
+		dataDev,
+		hashDev,
+		t.DataBlockSize,
+		t.HashBlockSize,
+		t.DataBlocks,
+		t.HashOffset/int64(t.HashBlockSize), // hash start block
+		algorithm,
+		hex.EncodeToString(t.RootHash),
+		salt)
+}
+
+// DataSectors returns the size of the data in 512 byte sectors, i.e. the
+// length of the device mapper table entry.
+func (t *Tree) DataSectors() uint64 {
+	return t.DataBlocks * uint64(t.DataBlockSize) / 512
+}
+
+// Build computes the hash tree for all data read from r, whose size must be a
+// multiple of the data block size.
+func Build(r io.Reader, opts Options) (*Tree, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	t := &Tree{
+		DataBlockSize: opts.DataBlockSize,
+		HashBlockSize: opts.HashBlockSize,
+		Salt:          bytes.Clone(opts.Salt),
+	}
+
+	// Hash all data blocks, which results in the lowest level of the tree.
+	var hashes []byte
+	block := make([]byte, t.DataBlockSize)
+	for {
+		n, err := io.ReadFull(r, block)
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("verity: data size is not a multiple of the data block size (%d bytes)", t.DataBlockSize)
+		}
+		if err != nil {
+			return nil, err
+		}
+		hashes = t.hash(hashes, block[:n])
+		t.DataBlocks++
+	}
+	if t.DataBlocks == 0 {
+		return nil, fmt.Errorf("verity: no data")
+	}
+
+	// Like the kernel, use as many levels as necessary for the top level to
+	// consist of a single hash block. A single data block needs no hash
+	// blocks at all: its hash is the root hash.
+	hashesPerBlock := t.HashBlockSize / digestSize
+	for len(hashes) > digestSize {
+		var level []byte
+		for len(hashes) > 0 {
+			n := min(len(hashes), hashesPerBlock*digestSize)
+			hashBlock := make([]byte, t.HashBlockSize) // zero-padded
+			copy(hashBlock, hashes[:n])
+			hashes = hashes[n:]
+			level = append(level, hashBlock...)
+		}
+		t.levels = append([][]byte{level}, t.levels...)
+		for off := 0; off < len(level); off += t.HashBlockSize {
+			hashes = t.hash(hashes, level[off:off+t.HashBlockSize])
+		}
+	}
+	t.RootHash = hashes
+	return t, nil
+}
+
+// hash appends the salted hash of block to dst.
+func (t *Tree) hash(dst, block []byte) []byte {
+	h := sha256.New()
+	h.Write(t.Salt)
+	h.Write(block)
+	return h.Sum(dst)
+}
+
+// Write computes the hash tree for all data read from data (see Build) and
+// writes it to the separate hash device w.
+func Write(w io.Writer, data io.Reader, opts Options) (*Tree, error) {
+	t, err := Build(data, opts)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := t.WriteTo(w); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Append computes the hash tree for the contents of f (e.g. a finished
+// SquashFS image, see Build) and appends it to f. The size of f must be a
+// multiple of both the data and hash block size.
+func Append(f io.ReadWriteSeeker, opts Options) (*Tree, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	t, err := Build(f, opts)
+	if err != nil {
+		return nil, err
+	}
+	t.HashOffset = int64(t.DataBlocks) * int64(t.DataBlockSize)
+	if t.HashOffset%int64(t.HashBlockSize) != 0 {
+		return nil, fmt.Errorf("verity: data size %d is not a multiple of the hash block size (%d bytes)", t.HashOffset, t.HashBlockSize)
+	}
+	if _, err := f.Seek(t.HashOffset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err := t.WriteTo(f); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
@@ -0,0 +1,276 @@
+package verity
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// verifyBlock verifies data block idx of data against the hash tree (read
+// from hashDev at t.HashOffset) like the Linux kernel's dm-verity target does.
+func verifyBlock(t *testing.T, tree *Tree, data, hashDev []byte, idx uint64) error {
+	t.Helper()
+	hashPerBlockBits := bits.Len(uint(tree.HashBlockSize/sha256.Size)) - 1
+	levels := 0
+	for levels*hashPerBlockBits < 64 && (tree.DataBlocks-1)>>(hashPerBlockBits*levels) != 0 {
+		levels++
+	}
+	// Compute the position of each level, top-level first.
+	levelBlock := make([]uint64, levels)
+	position := uint64(tree.HashOffset) / uint64(tree.HashBlockSize)
+	for i := levels - 1; i >= 0; i-- {
+		levelBlock[i] = position
+		shift := hashPerBlockBits * (i + 1)
+		position += (tree.DataBlocks + (1 << shift) - 1) >> shift
+	}
+	salted := func(b []byte) []byte {
+		h := sha256.New()
+		h.Write(tree.Salt)
+		h.Write(b)
+		return h.Sum(nil)
+	}
+	want := tree.RootHash
+	for i := levels - 1; i >= 0; i-- {
+		hashBlock := levelBlock[i] + (idx >> (hashPerBlockBits * (i + 1)))
+		b := hashDev[hashBlock*uint64(tree.HashBlockSize):][:tree.HashBlockSize]
+		if got := salted(b); !bytes.Equal(got, want) {
+			return fmt.Errorf("level %d: hash block %d: hash mismatch", i, hashBlock)
+		}
+		off := (idx >> (hashPerBlockBits * i)) & (1<<hashPerBlockBits - 1) * sha256.Size
+		want = b[off : off+sha256.Size]
+	}
+	if got := salted(data[idx*uint64(tree.DataBlockSize):][:tree.DataBlockSize]); !bytes.Equal(got, want) {
+		return fmt.Errorf("data block %d: hash mismatch", idx)
+	}
+	return nil
+}
+
+func TestBuild(t *testing.T) {
+	for _, tt := range []struct {
+		dataBlocks int
+		opts       Options
+	}{
+		{1, Options{}},
+		{2, Options{Salt: []byte("salt")}},
+		{128, Options{}},
+		{129, Options{Salt: bytes.Repeat([]byte{0xaa}, 32)}},
+		{1000, Options{DataBlockSize: 512, HashBlockSize: 512}},
+		{300, Options{DataBlockSize: 4096, HashBlockSize: 1024}},
+	} {
+		t.Run(fmt.Sprintf("%d blocks", tt.dataBlocks), func(t *testing.T) {
+			opts := tt.opts
+			bs := opts.DataBlockSize
+			if bs == 0 {
+				bs = 4096
+			}
+			data := make([]byte, tt.dataBlocks*bs)
+			for i := range data {
+				data[i] = byte(i / bs) // distinct blocks
+			}
+			var hashDev bytes.Buffer
+			tree, err := Write(&hashDev, bytes.NewReader(data), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := tree.DataBlocks, uint64(tt.dataBlocks); got != want {
+				t.Errorf("unexpected number of data blocks: got %d, want %d", got, want)
+			}
+			if got, want := int64(hashDev.Len()), tree.Size(); got != want {
+				t.Errorf("unexpected hash tree size: got %d, want %d", got, want)
+			}
+			for idx := uint64(0); idx < tree.DataBlocks; idx++ {
+				if err := verifyBlock(t, tree, data, hashDev.Bytes(), idx); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// Corrupting a data block must be detected.
+			data[len(data)-1] ^= 0xff
+			if err := verifyBlock(t, tree, data, hashDev.Bytes(), tree.DataBlocks-1); err == nil {
+				t.Errorf("verifying corrupted data block unexpectedly succeeded")
+			}
+		})
+	}
+}
+
+func TestRootHash(t *testing.T) {
+	// A single data block is verified directly against the root hash.
+	block := bytes.Repeat([]byte{1}, 4096)
+	tree, err := Build(bytes.NewReader(block), Options{Salt: []byte("salt")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := sha256.Sum256(append([]byte("salt"), block...))
+	if !bytes.Equal(tree.RootHash, want[:]) {
+		t.Errorf("unexpected root hash: got %x, want %x", tree.RootHash, want)
+	}
+	if got := tree.Size(); got != 0 {
+		t.Errorf("unexpected hash tree size: got %d, want 0", got)
+	}
+
+	// Two data blocks result in one (zero-padded) hash block.
+	data := append(bytes.Clone(block), make([]byte, 4096)...)
+	tree, err = Build(bytes.NewReader(data), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h0 := sha256.Sum256(block)
+	h1 := sha256.Sum256(make([]byte, 4096))
+	hashBlock := make([]byte, 4096)
+	copy(hashBlock, h0[:])
+	copy(hashBlock[32:], h1[:])
+	want = sha256.Sum256(hashBlock)
+	if !bytes.Equal(tree.RootHash, want[:]) {
+		t.Errorf("unexpected root hash: got %x, want %x", tree.RootHash, want)
+	}
+}
+
+func TestAppend(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data := bytes.Repeat([]byte("gokrazy!"), 200*4096/8)
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	salt, _ := hex.DecodeString("0102030405060708")
+	tree, err := Append(f, Options{Salt: salt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := tree.HashOffset, int64(len(data)); got != want {
+		t.Errorf("unexpected hash offset: got %d, want %d", got, want)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := int64(len(b)), int64(len(data))+tree.Size(); got != want {
+		t.Errorf("unexpected image size: got %d, want %d", got, want)
+	}
+	for idx := uint64(0); idx < tree.DataBlocks; idx++ {
+		if err := verifyBlock(t, tree, b, b, idx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := fmt.Sprintf("1 /dev/sda2 /dev/sda2 4096 4096 200 200 sha256 %x 0102030405060708", tree.RootHash)
+	if got := tree.Params("/dev/sda2", "/dev/sda2"); got != want {
+		t.Errorf("Params() = %q, want %q", got, want)
+	}
+	if got, want := tree.DataSectors(), uint64(200*8); got != want {
+		t.Errorf("DataSectors() = %d, want %d", got, want)
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	for _, tt := range []struct {
+		desc string
+		data []byte
+		opts Options
+		want string
+	}{
+		{"empty", nil, Options{}, "no data"},
+		{"partial block", make([]byte, 5000), Options{}, "multiple of the data block size"},
+		{"block size", make([]byte, 4096), Options{DataBlockSize: 1000}, "invalid block size"},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			_, err := Build(bytes.NewReader(tt.data), tt.opts)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Build = %v, want error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// TestVeritysetup compares hash trees with those created by veritysetup(8),
+// the reference implementation.
+func TestVeritysetup(t *testing.T) {
+	if _, err := exec.LookPath("veritysetup"); err != nil {
+		t.Skip("veritysetup not found in $PATH")
+	}
+	for _, tt := range []struct {
+		dataBlocks int
+		opts       Options
+	}{
+		{1, Options{}},
+		{1, Options{Salt: []byte("salt")}},
+		{2, Options{Salt: []byte("salt")}},
+		{129, Options{Salt: bytes.Repeat([]byte{0xaa}, 32)}},
+		{1000, Options{DataBlockSize: 512, HashBlockSize: 512}},
+		{300, Options{DataBlockSize: 4096, HashBlockSize: 1024}},
+	} {
+		t.Run(fmt.Sprintf("%d blocks, salt %x", tt.dataBlocks, tt.opts.Salt), func(t *testing.T) {
+			opts := tt.opts
+			bs := opts.DataBlockSize
+			if bs == 0 {
+				bs = 4096
+			}
+			data := make([]byte, tt.dataBlocks*bs)
+			for i := range data {
+				data[i] = byte(i / bs) // distinct blocks
+			}
+			var hashDev bytes.Buffer
+			tree, err := Write(&hashDev, bytes.NewReader(data), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dir := t.TempDir()
+			dataPath := filepath.Join(dir, "data")
+			hashPath := filepath.Join(dir, "hash")
+			if err := os.WriteFile(dataPath, data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(hashPath, nil, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			salt := "-"
+			if len(tree.Salt) > 0 {
+				salt = hex.EncodeToString(tree.Salt)
+			}
+			out, err := exec.Command("veritysetup", "format",
+				"--no-superblock",
+				"--hash=sha256",
+				"--salt="+salt,
+				fmt.Sprintf("--data-block-size=%d", tree.DataBlockSize),
+				fmt.Sprintf("--hash-block-size=%d", tree.HashBlockSize),
+				dataPath,
+				hashPath).CombinedOutput()
+			if err != nil {
+				t.Fatalf("veritysetup: %v\n%s", err, out)
+			}
+			m := regexp.MustCompile(`(?m)^Root hash:\s+([0-9a-f]+)$`).FindSubmatch(out)
+			if m == nil {
+				t.Fatalf("root hash not found in veritysetup output:\n%s", out)
+			}
+			if got, want := hex.EncodeToString(tree.RootHash), string(m[1]); got != want {
+				t.Errorf("unexpected root hash: got %s, veritysetup: %s", got, want)
+			}
+			want, err := os.ReadFile(hashPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// veritysetup might extend the hash device beyond the tree.
+			if len(want) < hashDev.Len() || !bytes.Equal(want[:hashDev.Len()], hashDev.Bytes()) {
+				t.Errorf("hash tree differs from veritysetup (%d bytes, veritysetup: %d bytes)", hashDev.Len(), len(want))
+			}
+			if rest := want[min(len(want), hashDev.Len()):]; len(bytes.Trim(rest, "\x00")) > 0 {
+				t.Errorf("veritysetup hash device contains additional data")
+			}
+		})
+	}
+}